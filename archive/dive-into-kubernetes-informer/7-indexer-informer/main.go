@@ -3,9 +3,9 @@ package main
 import (
 	"fmt"
 	"github.com/spongeprojects/magicconch"
+	"github.com/wbsnail/articles/archive/dive-into-kubernetes-informer/probeserver"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
-	"strings"
 )
 
 func main() {
@@ -13,21 +13,33 @@ func main() {
 
 	lw := newConfigMapsListerWatcher()
 	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	// 事件也转发给 probe 服务，它要在 informer 创建后才能创建，但事件在 Run 之后才会发生
+	var probe *probeserver.Server
 	indexer, informer := cache.NewIndexerInformer(lw, &corev1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
+			probe.OnAdd(obj)
 			configMap, ok := obj.(*corev1.ConfigMap)
 			if !ok {
 				return
 			}
 			fmt.Printf("created: %s\n", configMap.Name)
 		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			probe.OnUpdate(oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			probe.OnDelete(obj)
+		},
 	}, indexers)
+	probe = probeserver.New(indexer, informer)
 
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 
 	fmt.Println("Start syncing....")
 
+	go probe.Start(probeserver.Address)
+
 	go informer.Run(stopCh)
 
 	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
@@ -40,13 +52,5 @@ func main() {
 		fmt.Println(k)
 	}
 
-	startProbeServer(func(message string) string {
-		keys, err := indexer.IndexKeys(cache.NamespaceIndex, "tmp")
-		if err != nil {
-			return "Error: " + err.Error()
-		}
-		return strings.Join(keys, ", ")
-	})
-
 	<-stopCh
 }
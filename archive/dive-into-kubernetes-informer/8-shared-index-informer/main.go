@@ -3,9 +3,9 @@ package main
 import (
 	"fmt"
 	"github.com/spongeprojects/magicconch"
+	"github.com/wbsnail/articles/archive/dive-into-kubernetes-informer/probeserver"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
-	"strings"
 )
 
 func main() {
@@ -23,12 +23,16 @@ func main() {
 			fmt.Printf("created: %s\n", configMap.Name)
 		},
 	})
+	probe := probeserver.New(informer.GetIndexer(), informer)
+	informer.AddEventHandler(probe)
 
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 
 	fmt.Println("Start syncing....")
 
+	go probe.Start(probeserver.Address)
+
 	go informer.Run(stopCh)
 
 	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
@@ -41,13 +45,5 @@ func main() {
 		fmt.Println(k)
 	}
 
-	startProbeServer(func(message string) string {
-		keys, err := informer.GetIndexer().IndexKeys(cache.NamespaceIndex, "tmp")
-		if err != nil {
-			return "Error: " + err.Error()
-		}
-		return strings.Join(keys, ", ")
-	})
-
 	<-stopCh
 }
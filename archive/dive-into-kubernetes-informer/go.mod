@@ -9,4 +9,5 @@ require (
 	k8s.io/apimachinery v0.21.0
 	k8s.io/client-go v0.21.0
 	k8s.io/klog/v2 v2.8.0
+	sigs.k8s.io/yaml v1.2.0
 )
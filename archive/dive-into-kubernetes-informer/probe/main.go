@@ -1,33 +1,287 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/pkg/errors"
-	"github.com/spongeprojects/magicconch"
-	"net"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// 单个事件最大 16MiB，足够放下一个 ConfigMap
+const maxEventSize = 16 * 1024 * 1024
+
+type Command struct {
+	Name    string
+	Args    []string
+	Summary string
+	// 是否支持 -o name
+	Names bool
+	Run   func(probe *Probe, args []string) error
+}
+
+var commands = []*Command{
+	{Name: "status", Summary: "show whether the cache has synced and how many objects it holds", Run: (*Probe).status},
+	{Name: "keys", Summary: "list the keys of all cached objects", Names: true, Run: (*Probe).keys},
+	{Name: "get", Args: []string{"<namespace>/<name>"}, Summary: "show a cached object", Names: true, Run: (*Probe).get},
+	{Name: "index", Args: []string{"<index>", "<value>"}, Summary: "list the keys of objects in an index", Names: true, Run: (*Probe).index},
+	{Name: "watch", Summary: "stream changes of cached objects until interrupted", Names: true, Run: (*Probe).watch},
+}
+
+// Probe 是探针服务的客户端，每个子命令对应它的一个方法
+type Probe struct {
+	address string
+	timeout time.Duration
+	output  string
+	filters url.Values
+	// ctx 结束时请求被取消，watch 正常退出
+	ctx context.Context
+	out io.Writer
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("missing argument: message")
-		return
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: probe <command> [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, command := range commands {
+		fmt.Fprintf(w, "  %-28s %s\n", strings.Join(append([]string{command.Name}, command.Args...), " "), command.Summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "run \"probe <command> -h\" for the flags of a command")
+	fmt.Fprintln(w, "exit status is 1 on errors and 2 on usage errors")
+}
+
+// run 执行 args 指定的子命令，结果写到 stdout，错误和用法写到 stderr，返回退出码
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage(stderr)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+
+	var command *Command
+	for _, c := range commands {
+		if c.Name == args[0] {
+			command = c
+		}
+	}
+	if command == nil {
+		fmt.Fprintf(stderr, "unknown command: %s\n\n", args[0])
+		usage(stderr)
+		return exitUsage
+	}
+
+	probe := &Probe{filters: url.Values{}, ctx: ctx, out: stdout}
+	flags := flag.NewFlagSet("probe "+command.Name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&probe.address, "address", "localhost:12345", "address of the probe server")
+	flags.DurationVar(&probe.timeout, "timeout", 5*time.Second, "request timeout, for watch it only limits waiting for the server to respond")
+	flags.StringVar(&probe.output, "o", "table", "output format: table, json, yaml or name")
+	var namespace, prefix, selector string
+	if command.Name == "watch" {
+		flags.StringVar(&namespace, "namespace", "", "only watch objects in this namespace")
+		flags.StringVar(&prefix, "prefix", "", "only watch objects with names starting with this prefix")
+		flags.StringVar(&selector, "l", "", "only watch objects matching this label selector, like app=web")
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: probe %s [flags] %s\n\n", command.Name, strings.Join(command.Args, " "))
+		flags.PrintDefaults()
+	}
+
+	// 参数和 flag 可以交替出现，比如 "probe get default/foo -o yaml"
+	var positional []string
+	rest := args[1:]
+	for {
+		if err := flags.Parse(rest); err != nil {
+			if err == flag.ErrHelp {
+				return exitOK
+			}
+			return exitUsage
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		rest = flags.Args()[1:]
+	}
+
+	switch probe.output {
+	case "table", "json", "yaml":
+	case "name":
+		if !command.Names {
+			fmt.Fprintf(stderr, "output format name is not supported by %s\n", command.Name)
+			return exitUsage
+		}
+	default:
+		fmt.Fprintf(stderr, "unknown output format: %s\n", probe.output)
+		return exitUsage
+	}
+	if len(positional) != len(command.Args) {
+		flags.Usage()
+		return exitUsage
+	}
+	for name, value := range map[string]string{"namespace": namespace, "prefix": prefix, "labelSelector": selector} {
+		if value != "" {
+			probe.filters.Set(name, value)
+		}
+	}
+
+	if err := command.Run(probe, positional); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	return exitOK
+}
+
+func (probe *Probe) url(path ...string) string {
+	for i := range path {
+		path[i] = url.PathEscape(path[i])
+	}
+	address := probe.address
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return strings.TrimSuffix(address, "/") + "/" + strings.Join(path, "/")
+}
+
+// fetch 返回响应体，非 2xx 的响应转换为错误
+func (probe *Probe) fetch(path ...string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(probe.ctx, http.MethodGet, probe.url(path...), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request error")
+	}
+	client := &http.Client{Timeout: probe.timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "request probe server error")
 	}
+	defer response.Body.Close()
 
-	message := os.Args[1]
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read response error")
+	}
+	if err := responseError(response, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
 
-	conn, err := net.Dial("tcp", "localhost:12345")
-	magicconch.Must(err)
+func responseError(response *http.Response, body []byte) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+	var probeError struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &probeError) == nil && probeError.Error != "" {
+		return errors.Errorf("%s: %s", response.Status, probeError.Error)
+	}
+	return errors.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+}
 
-	_, err = conn.Write([]byte(message))
+func (probe *Probe) status(args []string) error {
+	body, err := probe.fetch("status")
 	if err != nil {
-		fmt.Println(errors.Wrap(err, "send message error"))
+		return err
 	}
+	return probe.render(body, &statusView{})
+}
 
-	response := make([]byte, 4096)
-	_, err = conn.Read(response)
-	magicconch.Must(err)
+func (probe *Probe) keys(args []string) error {
+	body, err := probe.fetch("keys")
+	if err != nil {
+		return err
+	}
+	return probe.render(body, &keysView{})
+}
 
-	fmt.Println("Current state:\n")
-	fmt.Println(string(response))
+func (probe *Probe) get(args []string) error {
+	parts := strings.SplitN(args[0], "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.Errorf("invalid key %q, expected <namespace>/<name>", args[0])
+	}
+	body, err := probe.fetch("objects", parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+	return probe.render(body, &objectView{})
+}
+
+func (probe *Probe) index(args []string) error {
+	body, err := probe.fetch("index", args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return probe.render(body, &keysView{})
+}
+
+func (probe *Probe) watch(args []string) error {
+	ctx := probe.ctx
+	watchURL := probe.url("watch")
+	if len(probe.filters) > 0 {
+		watchURL += "?" + probe.filters.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, watchURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "create request error")
+	}
+	request.Header.Set("Accept", "application/x-ndjson")
+
+	// 连接会一直保持，超时只作用于等待响应头
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = probe.timeout
+	response, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errors.Wrap(err, "request probe server error")
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		body, _ := io.ReadAll(response.Body)
+		return responseError(response, body)
+	}
+
+	printer := newEventPrinter(probe.out, probe.output)
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	for scanner.Scan() {
+		if err := printer.print(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		// Ctrl+C 正常退出
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "read watch stream error")
+	}
+	return errors.New("watch closed by the probe server")
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/wbsnail/articles/archive/dive-into-kubernetes-informer/probeserver"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func configMap(namespace, name string, labels map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}}
+}
+
+// startProbe 用假的 clientset 运行 informer，等缓存同步后返回 probe 服务的地址
+func startProbe(t *testing.T, objects ...runtime.Object) (kubernetes.Interface, string) {
+	t.Helper()
+	clientset := fake.NewSimpleClientset(objects...)
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return clientset.CoreV1().ConfigMaps("").List(context.Background(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return clientset.CoreV1().ConfigMaps("").Watch(context.Background(), options)
+		},
+	}
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	informer := cache.NewSharedIndexInformer(lw, &corev1.ConfigMap{}, 0, indexers)
+	server := probeserver.New(informer.GetIndexer(), informer)
+	informer.AddEventHandler(server)
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		t.Fatal("timed out waiting for caches to sync")
+	}
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return clientset, httpServer.URL
+}
+
+// syncBuffer 是可以并发写入和读取的 bytes.Buffer，watch 在另一个 goroutine 中输出
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func runProbe(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunUsage(t *testing.T) {
+	for _, c := range []struct {
+		args   []string
+		code   int
+		stderr string
+	}{
+		{nil, exitUsage, "usage: probe <command>"},
+		{[]string{"help"}, exitOK, "commands:"},
+		{[]string{"-h"}, exitOK, "commands:"},
+		{[]string{"list"}, exitUsage, "unknown command: list"},
+		{[]string{"get"}, exitUsage, "usage: probe get [flags] <namespace>/<name>"},
+		{[]string{"get", "default/foo", "default/bar"}, exitUsage, "usage: probe get"},
+		{[]string{"get", "-h"}, exitOK, "-address"},
+		{[]string{"status", "-o", "name"}, exitUsage, "output format name is not supported by status"},
+		{[]string{"keys", "-o", "xml"}, exitUsage, "unknown output format: xml"},
+		{[]string{"keys", "-bogus"}, exitUsage, "flag provided but not defined: -bogus"},
+		{[]string{"keys", "-l", "app=web"}, exitUsage, "flag provided but not defined: -l"},
+	} {
+		code, stdout, stderr := runProbe(c.args...)
+		if code != c.code || !strings.Contains(stderr, c.stderr) || stdout != "" {
+			t.Fatalf("%q: expected exit %d with %q, got %d with %q, %q", c.args, c.code, c.stderr, code, stderr, stdout)
+		}
+	}
+}
+
+func TestRunOutputs(t *testing.T) {
+	_, url := startProbe(t,
+		configMap("default", "foo", map[string]string{"app": "web"}),
+		configMap("tmp", "bar", nil),
+	)
+	for _, c := range []struct {
+		args   []string
+		stdout []string
+	}{
+		{[]string{"status"}, []string{"SYNCED", "true", "namespace"}},
+		{[]string{"keys"}, []string{"NAMESPACE   NAME", "default     foo", "tmp         bar"}},
+		{[]string{"keys", "-o", "name"}, []string{"default/foo\ntmp/bar\n"}},
+		{[]string{"index", "namespace", "tmp", "-o", "name"}, []string{"tmp/bar\n"}},
+		// 参数和 flag 可以交替出现
+		{[]string{"get", "default/foo", "-o", "name"}, []string{"default/foo\n"}},
+		{[]string{"get", "-o", "yaml", "default/foo"}, []string{"name: foo", "app: web"}},
+		{[]string{"get", "default/foo"}, []string{"RESOURCEVERSION", "app=web"}},
+	} {
+		code, stdout, stderr := runProbe(append(c.args, "-address", url)...)
+		if code != exitOK {
+			t.Fatalf("%q: expected exit 0, got %d: %s", c.args, code, stderr)
+		}
+		for _, expected := range c.stdout {
+			if !strings.Contains(stdout, expected) {
+				t.Fatalf("%q: expected %q in %q", c.args, expected, stdout)
+			}
+		}
+	}
+
+	code, stdout, _ := runProbe("get", "default/foo", "-o", "json", "-address", url)
+	var object corev1.ConfigMap
+	if code != exitOK || json.Unmarshal([]byte(stdout), &object) != nil || object.Name != "foo" {
+		t.Fatalf("expected the object as JSON, got %d, %q", code, stdout)
+	}
+
+	for _, c := range []struct {
+		args   []string
+		stderr string
+	}{
+		{[]string{"get", "default/missing"}, "404 Not Found"},
+		{[]string{"get", "foo"}, "invalid key \"foo\""},
+		{[]string{"index", "missing", "value"}, "404 Not Found"},
+	} {
+		code, _, stderr := runProbe(append(c.args, "-address", url)...)
+		if code != exitError || !strings.Contains(stderr, c.stderr) {
+			t.Fatalf("%q: expected exit 1 with %q, got %d with %q", c.args, c.stderr, code, stderr)
+		}
+	}
+	if code, _, stderr := runProbe("status", "-address", "127.0.0.1:1"); code != exitError || !strings.Contains(stderr, "request probe server error") {
+		t.Fatalf("expected exit 1 without a probe server, got %d with %q", code, stderr)
+	}
+}
+
+func TestRunWatch(t *testing.T) {
+	clientset, url := startProbe(t)
+	for _, c := range []struct {
+		output string
+		// expected 是输出 tmp/new 时应有的内容
+		expected string
+	}{
+		{"name", "tmp/new\n"},
+		{"table", "ADDED      tmp                  new                                      app=web\n"},
+		{"json", `"key":"tmp/new"`},
+		{"yaml", "---\nkey: tmp/new\n"},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		stdout := &syncBuffer{}
+		var stderr bytes.Buffer
+		done := make(chan int)
+		go func() {
+			done <- run(ctx, []string{"watch", "-o", c.output, "-namespace", "tmp", "-address", url}, stdout, &stderr)
+		}()
+
+		// 等 watch 连上再改动对象，只有 tmp 中的会输出
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var status probeserver.Status
+			code, body, _ := runProbe("status", "-o", "json", "-address", url)
+			if code == exitOK && json.Unmarshal([]byte(body), &status) == nil && status.Watchers == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("watch didn't connect")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, namespace := range []string{"default", "tmp"} {
+			if _, err := clientset.CoreV1().ConfigMaps(namespace).Create(context.Background(),
+				configMap(namespace, "new", map[string]string{"app": "web"}), metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for !strings.Contains(stdout.String(), c.expected) {
+			if time.Now().After(deadline) {
+				t.Fatalf("-o %s: expected %q in %q", c.output, c.expected, stdout.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if strings.Contains(stdout.String(), "default") {
+			t.Fatalf("-o %s: expected only the objects in tmp, got %q", c.output, stdout.String())
+		}
+
+		// 中断后正常退出
+		cancel()
+		if code := <-done; code != exitOK {
+			t.Fatalf("-o %s: expected exit 0 once interrupted, got %d: %s", c.output, code, stderr.String())
+		}
+		for _, namespace := range []string{"default", "tmp"} {
+			if err := clientset.CoreV1().ConfigMaps(namespace).Delete(context.Background(), "new", metav1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestEventPrinter(t *testing.T) {
+	added := `{"type":"ADDED","key":"default/foo","object":{"metadata":{"namespace":"default","name":"foo","labels":{"app":"web"}}}}`
+	deleted := `{"type":"DELETED","key":"foo"}`
+	for _, c := range []struct {
+		output   string
+		expected string
+	}{
+		{"table", "EVENT      NAMESPACE            NAME                                     LABELS\n" +
+			"ADDED      default              foo                                      app=web\n" +
+			"DELETED    <none>               foo                                      <none>\n"},
+		{"name", "default/foo\nfoo\n"},
+		{"json", added + "\n" + deleted + "\n"},
+		{"yaml", "---\nkey: default/foo\nobject:\n  metadata:\n    labels:\n      app: web\n    name: foo\n    namespace: default\ntype: ADDED\n" +
+			"---\nkey: foo\ntype: DELETED\n"},
+	} {
+		var out bytes.Buffer
+		printer := newEventPrinter(&out, c.output)
+		for _, line := range []string{added, deleted} {
+			if err := printer.print([]byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if out.String() != c.expected {
+			t.Fatalf("-o %s: expected %q, got %q", c.output, c.expected, out.String())
+		}
+	}
+
+	printer := newEventPrinter(&bytes.Buffer{}, "table")
+	if err := printer.print([]byte(`{"type":"ERROR","error":"too slow"}`)); err == nil || !strings.Contains(err.Error(), "too slow") {
+		t.Fatalf("expected the watch error, got %v", err)
+	}
+	if err := printer.print([]byte(`not json`)); err == nil {
+		t.Fatal("expected an event that doesn't decode to be refused")
+	}
+}
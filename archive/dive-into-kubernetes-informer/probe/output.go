@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// view 决定一种响应在 table 和 name 格式下怎么显示，json 和 yaml 直接转换响应体
+type view interface {
+	table(w io.Writer)
+	names() []string
+}
+
+func (probe *Probe) render(body []byte, view view) error {
+	switch probe.output {
+	case "json":
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, bytes.TrimSpace(body), "", "  "); err != nil {
+			return errors.Wrap(err, "decode response error")
+		}
+		buf.WriteByte('\n')
+		_, err := buf.WriteTo(probe.out)
+		return err
+	case "yaml":
+		out, err := yaml.JSONToYAML(body)
+		if err != nil {
+			return errors.Wrap(err, "decode response error")
+		}
+		_, err = probe.out.Write(out)
+		return err
+	}
+
+	if err := json.Unmarshal(body, view); err != nil {
+		return errors.Wrap(err, "decode response error")
+	}
+	if probe.output == "name" {
+		for _, name := range view.names() {
+			fmt.Fprintln(probe.out, name)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(probe.out, 0, 8, 3, ' ', 0)
+	view.table(w)
+	return w.Flush()
+}
+
+type statusView struct {
+	Synced          bool     `json:"synced"`
+	ResourceVersion string   `json:"resourceVersion"`
+	Objects         int      `json:"objects"`
+	Indexes         []string `json:"indexes"`
+	Watchers        int      `json:"watchers"`
+}
+
+func (view *statusView) table(w io.Writer) {
+	fmt.Fprintln(w, "SYNCED\tRESOURCEVERSION\tOBJECTS\tWATCHERS\tINDEXES")
+	fmt.Fprintf(w, "%t\t%s\t%d\t%d\t%s\n", view.Synced, orNone(view.ResourceVersion), view.Objects, view.Watchers,
+		orNone(strings.Join(view.Indexes, ",")))
+}
+
+func (view *statusView) names() []string {
+	return nil
+}
+
+type keysView struct {
+	Keys []string `json:"keys"`
+}
+
+func (view *keysView) table(w io.Writer) {
+	fmt.Fprintln(w, "NAMESPACE\tNAME")
+	for _, key := range view.Keys {
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		fmt.Fprintf(w, "%s\t%s\n", orNone(namespace), name)
+	}
+}
+
+func (view *keysView) names() []string {
+	return view.Keys
+}
+
+// objectView 只关心元数据，探针服务缓存的可以是任何类型的对象
+type objectView struct {
+	Metadata metav1.ObjectMeta `json:"metadata"`
+}
+
+func (view *objectView) table(w io.Writer) {
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tRESOURCEVERSION\tLABELS\tAGE")
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", orNone(view.Metadata.Namespace), view.Metadata.Name,
+		view.Metadata.ResourceVersion, orNone(labels.Set(view.Metadata.Labels).String()), age(view.Metadata.CreationTimestamp))
+}
+
+func (view *objectView) names() []string {
+	if view.Metadata.Namespace == "" {
+		return []string{view.Metadata.Name}
+	}
+	return []string{view.Metadata.Namespace + "/" + view.Metadata.Name}
+}
+
+type event struct {
+	Type   string          `json:"type"`
+	Key    string          `json:"key"`
+	Object json.RawMessage `json:"object"`
+	Error  string          `json:"error"`
+}
+
+// eventPrinter 逐个输出 watch 的事件，table 格式的列宽是固定的，因为不能等所有行到齐再对齐
+type eventPrinter struct {
+	out    io.Writer
+	output string
+	header bool
+}
+
+func newEventPrinter(out io.Writer, output string) *eventPrinter {
+	return &eventPrinter{out: out, output: output}
+}
+
+const eventFormat = "%-10s %-20s %-40s %s\n"
+
+// print 在收到 ERROR 事件时返回错误
+func (printer *eventPrinter) print(line []byte) error {
+	var e event
+	if err := json.Unmarshal(line, &e); err != nil {
+		return errors.Wrap(err, "decode event error")
+	}
+	if e.Type == "ERROR" {
+		return errors.Errorf("watch error: %s", e.Error)
+	}
+
+	switch printer.output {
+	case "json":
+		_, err := fmt.Fprintf(printer.out, "%s\n", line)
+		return err
+	case "yaml":
+		out, err := yaml.JSONToYAML(line)
+		if err != nil {
+			return errors.Wrap(err, "decode event error")
+		}
+		_, err = fmt.Fprintf(printer.out, "---\n%s", out)
+		return err
+	case "name":
+		_, err := fmt.Fprintln(printer.out, e.Key)
+		return err
+	}
+
+	var object objectView
+	if len(e.Object) > 0 {
+		if err := json.Unmarshal(e.Object, &object); err != nil {
+			return errors.Wrap(err, "decode event error")
+		}
+	}
+	if !printer.header {
+		fmt.Fprintf(printer.out, eventFormat, "EVENT", "NAMESPACE", "NAME", "LABELS")
+		printer.header = true
+	}
+	namespace, name, _ := cache.SplitMetaNamespaceKey(e.Key)
+	_, err := fmt.Fprintf(printer.out, eventFormat, e.Type, orNone(namespace), name,
+		orNone(labels.Set(object.Metadata.Labels).String()))
+	return err
+}
+
+func age(timestamp metav1.Time) string {
+	if timestamp.IsZero() {
+		return "<unknown>"
+	}
+	return duration.HumanDuration(time.Since(timestamp.Time))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
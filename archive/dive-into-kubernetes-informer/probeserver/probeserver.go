@@ -0,0 +1,347 @@
+// Package probeserver 通过 HTTP 提供 informer 缓存中的内容，供 probe 客户端查看，
+// 7-indexer-informer 和 8-shared-index-informer 共用。
+package probeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spongeprojects/magicconch"
+	"io"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"net/url"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Address 是 probe 服务监听的地址，probe 客户端默认连接这里
+const Address = ":12345"
+
+// Server 通过 HTTP 以 JSON 提供 informer 缓存中的内容：
+//
+//	GET /status                        缓存是否已同步、资源版本和对象数量
+//	GET /keys                          所有对象的 key
+//	GET /indexes                       所有索引的名称
+//	GET /index/{name}/{value}          索引中 value 对应的对象 key
+//	GET /objects/{namespace}/{name}    完整的对象，?format=yaml 或 Accept: application/yaml 时返回 YAML
+//	GET /watch                         持续推送对象的增删改事件，每行一个 JSON，?format=sse 或 Accept: text/event-stream
+//	                                   时用 Server-Sent Events，可以用 namespace、prefix（名称前缀）和 labelSelector 过滤
+//
+// Server 同时是 informer 的 ResourceEventHandler，事件由它转发给 /watch 的订阅者。
+type Server struct {
+	indexer  cache.Indexer
+	informer cache.Controller
+
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+}
+
+// watchBuffer 是每个订阅者最多积压的事件数，跟不上的订阅者会被断开，而不是拖慢 informer
+const watchBuffer = 256
+
+// sseKeepAlive 是没有事件时 Server-Sent Events 发送注释的间隔，避免连接被代理断开
+const sseKeepAlive = 15 * time.Second
+
+const (
+	EventAdded    = "ADDED"
+	EventModified = "MODIFIED"
+	EventDeleted  = "DELETED"
+	EventError    = "ERROR"
+)
+
+type Event struct {
+	Type   string      `json:"type"`
+	Key    string      `json:"key,omitempty"`
+	Object interface{} `json:"object,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type watcher struct {
+	namespace string
+	prefix    string
+	selector  labels.Selector
+	events    chan *Event
+	// dropped 在订阅者跟不上、事件被丢弃时关闭
+	dropped chan struct{}
+}
+
+type Status struct {
+	Synced          bool     `json:"synced"`
+	ResourceVersion string   `json:"resourceVersion"`
+	Objects         int      `json:"objects"`
+	Indexes         []string `json:"indexes"`
+	Watchers        int      `json:"watchers"`
+}
+
+type Keys struct {
+	Index string   `json:"index,omitempty"`
+	Value string   `json:"value,omitempty"`
+	Keys  []string `json:"keys"`
+}
+
+type Indexes struct {
+	Indexes []string `json:"indexes"`
+}
+
+type Error struct {
+	Error string `json:"error"`
+}
+
+func New(indexer cache.Indexer, informer cache.Controller) *Server {
+	return &Server{indexer: indexer, informer: informer, watchers: make(map[*watcher]bool)}
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET is allowed"))
+		return
+	}
+
+	// 按转义后的路径切分，value 和 name 中可以有转义的 "/"
+	var parts []string
+	for _, part := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid path"))
+			return
+		}
+		parts = append(parts, unescaped)
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "status":
+		writeJSON(w, http.StatusOK, server.status())
+	case len(parts) == 1 && parts[0] == "keys":
+		keys := server.indexer.ListKeys()
+		sort.Strings(keys)
+		writeJSON(w, http.StatusOK, &Keys{Keys: keys})
+	case len(parts) == 1 && parts[0] == "indexes":
+		writeJSON(w, http.StatusOK, &Indexes{Indexes: server.indexNames()})
+	case len(parts) == 3 && parts[0] == "index":
+		keys, err := server.indexer.IndexKeys(parts[1], parts[2])
+		if err != nil {
+			// 只有索引不存在时才会出错
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		sort.Strings(keys)
+		writeJSON(w, http.StatusOK, &Keys{Index: parts[1], Value: parts[2], Keys: keys})
+	case len(parts) == 3 && parts[0] == "objects":
+		server.serveObject(w, r, parts[1]+"/"+parts[2])
+	case len(parts) == 1 && parts[0] == "watch":
+		server.serveWatch(w, r)
+	default:
+		writeError(w, http.StatusNotFound, errors.Errorf("no such endpoint: %s", r.URL.Path))
+	}
+}
+
+func (server *Server) status() *Status {
+	server.mu.Lock()
+	watchers := len(server.watchers)
+	server.mu.Unlock()
+	return &Status{
+		Watchers:        watchers,
+		Synced:          server.informer.HasSynced(),
+		ResourceVersion: server.informer.LastSyncResourceVersion(),
+		Objects:         len(server.indexer.ListKeys()),
+		Indexes:         server.indexNames(),
+	}
+}
+
+func (server *Server) indexNames() []string {
+	names := []string{}
+	for name := range server.indexer.GetIndexers() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (server *Server) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj, exists, err := server.indexer.GetByKey(key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, errors.Errorf("no such object: %s", key))
+		return
+	}
+	if r.URL.Query().Get("format") == "yaml" || strings.Contains(r.Header.Get("Accept"), "yaml") {
+		body, err := yaml.Marshal(obj)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errors.Wrap(err, "encode yaml error"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(body)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (server *Server) serveWatch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	query := r.URL.Query()
+	selector, err := labels.Parse(query.Get("labelSelector"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid labelSelector"))
+		return
+	}
+	sse := query.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	watcher := &watcher{
+		namespace: query.Get("namespace"),
+		prefix:    query.Get("prefix"),
+		selector:  selector,
+		events:    make(chan *Event, watchBuffer),
+		dropped:   make(chan struct{}),
+	}
+	server.mu.Lock()
+	server.watchers[watcher] = true
+	server.mu.Unlock()
+	defer func() {
+		server.mu.Lock()
+		delete(server.watchers, watcher)
+		server.mu.Unlock()
+	}()
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var event *Event
+		select {
+		case event = <-watcher.events:
+		case <-watcher.dropped:
+			event = &Event{Type: EventError, Error: fmt.Sprintf("more than %d events behind, watch again", watchBuffer)}
+		case <-keepAlive.C:
+			if sse {
+				if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+			continue
+		case <-r.Context().Done():
+			return
+		}
+		if err := writeEvent(w, sse, event); err != nil {
+			return
+		}
+		flusher.Flush()
+		if event.Type == EventError {
+			return
+		}
+	}
+}
+
+func writeEvent(w io.Writer, sse bool, event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		body, _ = json.Marshal(&Event{Type: EventError, Error: errors.Wrap(err, "encode json error").Error()})
+	}
+	if sse {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, body)
+	} else {
+		_, err = w.Write(append(body, '\n'))
+	}
+	return err
+}
+
+func (server *Server) OnAdd(obj interface{}) {
+	server.notify(nil, obj)
+}
+
+func (server *Server) OnUpdate(oldObj, newObj interface{}) {
+	server.notify(oldObj, newObj)
+}
+
+func (server *Server) OnDelete(obj interface{}) {
+	// 错过删除事件时，informer 给的是最后已知状态的包装
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	server.notify(obj, nil)
+}
+
+// notify 把事件发给订阅者，对象在更新后才符合或不再符合过滤条件时，对订阅者来说是新增或删除。
+// 它在 informer 的 goroutine 中调用，不能阻塞。
+func (server *Server) notify(oldObj, newObj interface{}) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for watcher := range server.watchers {
+		oldMatches := oldObj != nil && watcher.matches(oldObj)
+		newMatches := newObj != nil && watcher.matches(newObj)
+		var event *Event
+		switch {
+		case oldMatches && newMatches:
+			event = &Event{Type: EventModified, Object: newObj}
+		case newMatches:
+			event = &Event{Type: EventAdded, Object: newObj}
+		case oldMatches:
+			event = &Event{Type: EventDeleted, Object: oldObj}
+		default:
+			continue
+		}
+		event.Key, _ = cache.MetaNamespaceKeyFunc(event.Object)
+		select {
+		case watcher.events <- event:
+		default:
+			close(watcher.dropped)
+			delete(server.watchers, watcher)
+		}
+	}
+}
+
+func (watcher *watcher) matches(obj interface{}) bool {
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	if watcher.namespace != "" && object.GetNamespace() != watcher.namespace {
+		return false
+	}
+	if !strings.HasPrefix(object.GetName(), watcher.prefix) {
+		return false
+	}
+	return watcher.selector.Matches(labels.Set(object.GetLabels()))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(&Error{Error: errors.Wrap(err, "encode json error").Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &Error{Error: err.Error()})
+}
+
+func (server *Server) Start(address string) {
+	fmt.Println("Starting probe server on " + address + "...")
+	magicconch.Must(http.ListenAndServe(address, server))
+}
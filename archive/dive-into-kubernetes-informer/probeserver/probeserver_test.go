@@ -0,0 +1,191 @@
+package probeserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func configMap(namespace, name string, labels map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}}
+}
+
+// startProbe 用假的 clientset 运行 informer，等缓存同步后返回 probe 服务的地址
+func startProbe(t *testing.T, objects ...runtime.Object) (kubernetes.Interface, string) {
+	t.Helper()
+	clientset := fake.NewSimpleClientset(objects...)
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return clientset.CoreV1().ConfigMaps("").List(context.Background(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return clientset.CoreV1().ConfigMaps("").Watch(context.Background(), options)
+		},
+	}
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	informer := cache.NewSharedIndexInformer(lw, &corev1.ConfigMap{}, 0, indexers)
+	server := New(informer.GetIndexer(), informer)
+	informer.AddEventHandler(server)
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		t.Fatal("timed out waiting for caches to sync")
+	}
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return clientset, httpServer.URL
+}
+
+func get(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response.StatusCode
+}
+
+func TestServeCache(t *testing.T) {
+	_, url := startProbe(t,
+		configMap("tmp", "foo", nil),
+		configMap("tmp", "bar", nil),
+		configMap("default", "baz", nil),
+	)
+
+	var status Status
+	if code := get(t, url+"/status", &status); code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	if !status.Synced || status.Objects != 3 || !reflect.DeepEqual(status.Indexes, []string{cache.NamespaceIndex}) {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	var keys Keys
+	get(t, url+"/keys", &keys)
+	if expected := []string{"default/baz", "tmp/bar", "tmp/foo"}; !reflect.DeepEqual(keys.Keys, expected) {
+		t.Fatalf("expected keys %v, got %v", expected, keys.Keys)
+	}
+
+	get(t, url+"/index/namespace/tmp", &keys)
+	if expected := []string{"tmp/bar", "tmp/foo"}; keys.Index != cache.NamespaceIndex || !reflect.DeepEqual(keys.Keys, expected) {
+		t.Fatalf("expected keys %v in the namespace index, got %+v", expected, keys)
+	}
+
+	var object corev1.ConfigMap
+	if code := get(t, url+"/objects/tmp/foo", &object); code != http.StatusOK || object.Name != "foo" {
+		t.Fatalf("unexpected object %d %+v", code, object)
+	}
+
+	response, err := http.Get(url + "/objects/tmp/foo?format=yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.Header.Get("Content-Type") != "application/yaml" || !strings.Contains(string(body), "name: foo") {
+		t.Fatalf("expected the object in yaml, got %q", body)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	_, url := startProbe(t)
+
+	for path, expected := range map[string]int{
+		"/objects/tmp/missing":    http.StatusNotFound,
+		"/index/missing/tmp":      http.StatusNotFound,
+		"/nothing":                http.StatusNotFound,
+		"/watch?labelSelector=!!": http.StatusBadRequest,
+	} {
+		var probeError Error
+		if code := get(t, url+path, &probeError); code != expected || probeError.Error == "" {
+			t.Fatalf("expected %d with an error for %s, got %d %+v", expected, path, code, probeError)
+		}
+	}
+
+	response, err := http.Post(url+"/keys", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected POST to be refused, got %d", response.StatusCode)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	clientset, url := startProbe(t, configMap("tmp", "foo", map[string]string{"app": "web"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/watch?namespace=tmp&labelSelector=app%3Dweb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	events := bufio.NewScanner(response.Body)
+	next := func() Event {
+		t.Helper()
+		if !events.Scan() {
+			t.Fatalf("watch ended: %v", events.Err())
+		}
+		var event Event
+		if err := json.Unmarshal(events.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	configMaps := clientset.CoreV1().ConfigMaps("tmp")
+	// 不符合过滤条件的不推送
+	if _, err := clientset.CoreV1().ConfigMaps("default").Create(ctx, configMap("default", "other", map[string]string{"app": "web"}), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := configMaps.Create(ctx, configMap("tmp", "bar", map[string]string{"app": "web"}), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Type != EventAdded || event.Key != "tmp/bar" {
+		t.Fatalf("expected tmp/bar to be added, got %+v", event)
+	}
+
+	// 更新后不再符合过滤条件，对订阅者来说是删除
+	if _, err := configMaps.Update(ctx, configMap("tmp", "foo", map[string]string{"app": "db"}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Type != EventDeleted || event.Key != "tmp/foo" {
+		t.Fatalf("expected tmp/foo to be deleted, got %+v", event)
+	}
+
+	if err := configMaps.Delete(ctx, "bar", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Type != EventDeleted || event.Key != "tmp/bar" {
+		t.Fatalf("expected tmp/bar to be deleted, got %+v", event)
+	}
+}
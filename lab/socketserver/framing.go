@@ -0,0 +1,216 @@
+package socketserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrInvalidFrame  = errors.New("invalid frame")
+)
+
+type FrameReader interface {
+	ReadFrame() ([]byte, error)
+}
+
+type FrameWriter interface {
+	WriteFrame(frame []byte) error
+}
+
+// Framing splits what's read from a connection into frames, and writes frames back.
+type Framing interface {
+	NewReader(conn net.Conn) FrameReader
+	NewWriter(conn net.Conn) FrameWriter
+}
+
+// FramingFunc builds a framing from functions, for readers or writers that need the connection.
+type FramingFunc struct {
+	Reader func(conn net.Conn) FrameReader
+	Writer func(conn net.Conn) FrameWriter
+}
+
+func (framing FramingFunc) NewReader(conn net.Conn) FrameReader { return framing.Reader(conn) }
+func (framing FramingFunc) NewWriter(conn net.Conn) FrameWriter { return framing.Writer(conn) }
+
+// Raw takes whatever a single read returns, up to bufferSize bytes, as a frame, and writes frames as they are.
+// It's what plain netcat clients expect, but a message may be split or merged with the next one.
+func Raw(bufferSize int) Framing {
+	return FramingFunc{
+		Reader: func(conn net.Conn) FrameReader { return &rawReader{reader: conn, size: bufferSize} },
+		Writer: func(conn net.Conn) FrameWriter { return &rawWriter{writer: conn} },
+	}
+}
+
+type rawReader struct {
+	reader io.Reader
+	size   int
+}
+
+func (reader *rawReader) ReadFrame() ([]byte, error) {
+	for {
+		frame := make([]byte, reader.size)
+		n, err := reader.reader.Read(frame)
+		if n > 0 {
+			return frame[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+type rawWriter struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func (writer *rawWriter) WriteFrame(frame []byte) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	_, err := writer.writer.Write(frame)
+	return err
+}
+
+// Lines reads newline-terminated frames of at most maxSize bytes, without the newline,
+// and writes every frame followed by a newline.
+func Lines(maxSize int) Framing {
+	return FramingFunc{
+		Reader: func(conn net.Conn) FrameReader { return NewLineReader(conn, maxSize) },
+		Writer: func(conn net.Conn) FrameWriter { return NewLineWriter(conn, maxSize) },
+	}
+}
+
+// NewLineReader reads the frames of Lines from any stream. After ReadFrame returns an error
+// other than io.EOF the stream is out of sync and should be closed.
+func NewLineReader(r io.Reader, maxSize int) FrameReader {
+	return &lineReader{reader: bufio.NewReaderSize(r, 4096), max: maxSize}
+}
+
+type lineReader struct {
+	reader *bufio.Reader
+	max    int
+}
+
+func (reader *lineReader) ReadFrame() ([]byte, error) {
+	var frame []byte
+	for {
+		chunk, err := reader.reader.ReadSlice('\n')
+		// the terminating '\n' doesn't count towards the frame size
+		if len(frame)+len(bytes.TrimSuffix(chunk, []byte("\n"))) > reader.max {
+			return nil, errors.Wrapf(ErrFrameTooLarge, "more than %d bytes", reader.max)
+		}
+		frame = append(frame, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(frame) > 0 {
+			// the last line doesn't need a newline
+			return frame, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		frame = frame[:len(frame)-1]
+		return bytes.TrimSuffix(frame, []byte("\r")), nil
+	}
+}
+
+// NewLineWriter writes the frames of Lines to any stream, it's safe to be used by multiple goroutines.
+func NewLineWriter(w io.Writer, maxSize int) FrameWriter {
+	return &lineWriter{writer: w, max: maxSize}
+}
+
+type lineWriter struct {
+	mu     sync.Mutex
+	writer io.Writer
+	max    int
+}
+
+func (writer *lineWriter) WriteFrame(frame []byte) error {
+	if len(frame) > writer.max {
+		return errors.Wrapf(ErrFrameTooLarge, "%d bytes", len(frame))
+	}
+	if bytes.IndexByte(frame, '\n') >= 0 {
+		return errors.Wrap(ErrInvalidFrame, "line frame contains newline")
+	}
+	line := make([]byte, 0, len(frame)+1)
+	line = append(append(line, frame...), '\n')
+	// one Write per frame so concurrent writers never interleave
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	_, err := writer.writer.Write(line)
+	return err
+}
+
+// LengthPrefixed reads and writes frames prefixed by their length as a 4-byte big-endian integer,
+// frames over maxSize bytes are refused.
+func LengthPrefixed(maxSize int) Framing {
+	return FramingFunc{
+		Reader: func(conn net.Conn) FrameReader { return NewLengthReader(conn, maxSize) },
+		Writer: func(conn net.Conn) FrameWriter { return NewLengthWriter(conn, maxSize) },
+	}
+}
+
+// NewLengthReader reads the frames of LengthPrefixed from any stream. After ReadFrame returns an error
+// other than io.EOF the stream is out of sync and should be closed.
+func NewLengthReader(r io.Reader, maxSize int) FrameReader {
+	return &lengthReader{reader: bufio.NewReader(r), max: maxSize}
+}
+
+type lengthReader struct {
+	reader io.Reader
+	max    int
+}
+
+func (reader *lengthReader) ReadFrame() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader.reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.Wrap(err, "read frame header error")
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if uint64(length) > uint64(reader.max) {
+		return nil, errors.Wrapf(ErrFrameTooLarge, "%d bytes", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(reader.reader, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "read frame body error")
+	}
+	return frame, nil
+}
+
+// NewLengthWriter writes the frames of LengthPrefixed to any stream, it's safe to be used by multiple goroutines.
+func NewLengthWriter(w io.Writer, maxSize int) FrameWriter {
+	return &lengthWriter{writer: w, max: maxSize}
+}
+
+type lengthWriter struct {
+	mu     sync.Mutex
+	writer io.Writer
+	max    int
+}
+
+func (writer *lengthWriter) WriteFrame(frame []byte) error {
+	if len(frame) > writer.max {
+		return errors.Wrapf(ErrFrameTooLarge, "%d bytes", len(frame))
+	}
+	buffer := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buffer, uint32(len(frame)))
+	copy(buffer[4:], frame)
+	// one Write per frame so concurrent writers never interleave
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	_, err := writer.writer.Write(buffer)
+	return err
+}
@@ -0,0 +1,73 @@
+package socketserver
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineReader(t *testing.T) {
+	reader := NewLineReader(strings.NewReader("one\r\n\nfour\nfive"), 4)
+	for _, expected := range []string{"one", "", "four", "five"} {
+		frame, err := reader.ReadFrame()
+		if err != nil || string(frame) != expected {
+			t.Fatalf("expected %q, got %q, %v", expected, frame, err)
+		}
+	}
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// the newline doesn't count towards the size
+	if _, err := NewLineReader(strings.NewReader("fives\n"), 4).ReadFrame(); errors.Cause(err) != ErrFrameTooLarge {
+		t.Fatalf("expected the line to be too large, got %v", err)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewLineWriter(&buffer, 4)
+	if err := writer.WriteFrame([]byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteFrame([]byte("a\nb")); errors.Cause(err) != ErrInvalidFrame {
+		t.Fatalf("expected a frame with a newline to be refused, got %v", err)
+	}
+	if err := writer.WriteFrame([]byte("fives")); errors.Cause(err) != ErrFrameTooLarge {
+		t.Fatalf("expected the frame to be too large, got %v", err)
+	}
+	if buffer.String() != "four\n" {
+		t.Fatalf("expected only the valid frame to be written, got %q", buffer.String())
+	}
+}
+
+func TestLengthPrefixed(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewLengthWriter(&buffer, 4)
+	for _, frame := range []string{"", "four"} {
+		if err := writer.WriteFrame([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WriteFrame([]byte("fives")); errors.Cause(err) != ErrFrameTooLarge {
+		t.Fatalf("expected the frame to be too large, got %v", err)
+	}
+
+	reader := NewLengthReader(&buffer, 4)
+	for _, expected := range []string{"", "four"} {
+		frame, err := reader.ReadFrame()
+		if err != nil || string(frame) != expected {
+			t.Fatalf("expected %q, got %q, %v", expected, frame, err)
+		}
+	}
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	truncated := NewLengthReader(bytes.NewReader([]byte{0, 0, 0, 4, 'a'}), 4)
+	if _, err := truncated.ReadFrame(); errors.Cause(err) != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/wbsnail/articles/lab/socketserver
+
+go 1.16
+
+require github.com/pkg/errors v0.9.1
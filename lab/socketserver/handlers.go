@@ -0,0 +1,57 @@
+package socketserver
+
+// Echo sends every frame back to the session it came from.
+func Echo() Handler {
+	return echoHandler{}
+}
+
+type echoHandler struct{}
+
+func (echoHandler) Connect(*Session) {}
+
+func (echoHandler) Frame(session *Session, frame []byte) {
+	session.Send(frame)
+}
+
+func (echoHandler) Disconnect(*Session) {}
+
+// RequestResponse answers every frame with what respond returns for it, nothing is sent for a nil answer.
+// respond is called from the server goroutine, so it has to be quick.
+func RequestResponse(respond func(request []byte) []byte) Handler {
+	return requestResponseHandler(respond)
+}
+
+type requestResponseHandler func(request []byte) []byte
+
+func (requestResponseHandler) Connect(*Session) {}
+
+func (respond requestResponseHandler) Frame(session *Session, frame []byte) {
+	if response := respond(frame); response != nil {
+		session.Send(response)
+	}
+}
+
+func (requestResponseHandler) Disconnect(*Session) {}
+
+// Broadcast sends every frame to all the sessions, including the one it came from.
+func Broadcast() Handler {
+	return &broadcastHandler{sessions: make(map[*Session]bool)}
+}
+
+type broadcastHandler struct {
+	sessions map[*Session]bool
+}
+
+func (handler *broadcastHandler) Connect(session *Session) {
+	handler.sessions[session] = true
+}
+
+func (handler *broadcastHandler) Frame(_ *Session, frame []byte) {
+	for session := range handler.sessions {
+		session.Send(frame)
+	}
+}
+
+func (handler *broadcastHandler) Disconnect(session *Session) {
+	delete(handler.sessions, session)
+}
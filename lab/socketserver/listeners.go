@@ -0,0 +1,247 @@
+package socketserver
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation, after stdin, stdout and stderr.
+const listenFDsStart = 3
+
+// restartEnv is set to the process ID of a server handing its listeners to a new process,
+// which can't know its own ID in advance to set LISTEN_PID. The old process may be gone
+// by the time the new one checks, so only its presence counts, it's not passed on anyway.
+const restartEnv = "SOCKET_SERVER_RESTART"
+
+// handoverEnv is set to the file descriptor of a pipe the old process of a hot restart closes
+// once it released what it shares with the new one, like files it writes to.
+const handoverEnv = "SOCKET_SERVER_HANDOVER"
+
+// Listeners opens the listeners of the server, or adopts the ones inherited through
+// systemd socket activation (LISTEN_FDS, LISTEN_PID and LISTEN_FDNAMES) or a hot restart.
+// An inherited listener is matched by name, or by order if the listeners have no names.
+type Listeners struct {
+	inherited []inheritedListener
+	opened    []inheritedListener
+	// handover is the read end of the handover pipe in a new process, the write end in the old one
+	handover *os.File
+}
+
+type inheritedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// InheritListeners takes over the listeners passed to the process, if any.
+func InheritListeners() (*Listeners, error) {
+	listeners := &Listeners{}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		os.Unsetenv(restartEnv)
+		os.Unsetenv(handoverEnv)
+	}()
+
+	if fd, err := strconv.Atoi(os.Getenv(handoverEnv)); err == nil && os.Getenv(restartEnv) != "" {
+		syscall.CloseOnExec(fd)
+		listeners.handover = os.NewFile(uintptr(fd), "handover")
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return listeners, nil
+	}
+	// the descriptors are only meant for us if the PID matches, they may be inherited from a parent otherwise
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) && os.Getenv(restartEnv) == "" {
+		return listeners, nil
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "listener "+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			listeners.Close()
+			return nil, errors.Wrapf(err, "inherit listener from fd %d error", fd)
+		}
+		inherited := inheritedListener{listener: listener}
+		if i < len(names) {
+			inherited.name = names[i]
+		}
+		listeners.inherited = append(listeners.inherited, inherited)
+	}
+	return listeners, nil
+}
+
+// Listen returns the inherited listener with this name, else the first unnamed one,
+// or a new one if none is left.
+func (listeners *Listeners) Listen(name, network, address string) (net.Listener, error) {
+	if listener := listeners.adopt(name, name); listener != nil {
+		return listener, nil
+	}
+	// systemd names the sockets without a FileDescriptorName "unknown"
+	if listener := listeners.adopt("", name); listener != nil {
+		return listener, nil
+	}
+	if listener := listeners.adopt("unknown", name); listener != nil {
+		return listener, nil
+	}
+
+	if network == "unix" {
+		// remove the socket file left by the last run
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	listeners.opened = append(listeners.opened, inheritedListener{name: name, listener: listener})
+	return listener, nil
+}
+
+// adopt takes the first inherited listener named match, for the listener called name.
+func (listeners *Listeners) adopt(match, name string) net.Listener {
+	for i, inherited := range listeners.inherited {
+		if inherited.name == match {
+			listeners.inherited = append(listeners.inherited[:i], listeners.inherited[i+1:]...)
+			listeners.opened = append(listeners.opened, inheritedListener{name: name, listener: inherited.listener})
+			fmt.Println("[INHERITED]: Listener " + name + " on " + inherited.listener.Addr().String())
+			return inherited.listener
+		}
+	}
+	return nil
+}
+
+// Close closes the inherited listeners nobody asked for.
+func (listeners *Listeners) Close() {
+	for _, inherited := range listeners.inherited {
+		inherited.listener.Close()
+	}
+	listeners.inherited = nil
+}
+
+// WaitHandover waits, in the new process of a hot restart, until the old one called HandOver or exited.
+// It returns right away otherwise.
+func (listeners *Listeners) WaitHandover() {
+	if listeners.handover == nil {
+		return
+	}
+	fmt.Println("[RESTART]: Waiting for the old process to hand over...")
+	io.Copy(io.Discard, listeners.handover)
+	listeners.handover.Close()
+	listeners.handover = nil
+}
+
+// HandOver tells the new process of a hot restart that this one released what they share,
+// it's a no-op if there was no restart.
+func (listeners *Listeners) HandOver() {
+	if listeners.handover != nil {
+		listeners.handover.Close()
+		listeners.handover = nil
+	}
+}
+
+// Restart starts a new copy of the server with the same arguments, handing it the listeners.
+// The caller shuts down afterwards, clients connected to it are not handed over, and calls HandOver
+// once the new process can take over the rest, which it waits for with WaitHandover.
+func (listeners *Listeners) Restart() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "find executable error")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	var names []string
+	for _, opened := range listeners.opened {
+		filer, ok := opened.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.New("listener " + opened.name + " can't be handed over")
+		}
+		file, err := filer.File()
+		if err != nil {
+			return errors.Wrap(err, "get listener file error")
+		}
+		files = append(files, file)
+		names = append(names, opened.name)
+	}
+
+	var env []string
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, "LISTEN_") && !strings.HasPrefix(variable, restartEnv+"=") {
+			env = append(env, variable)
+		}
+	}
+	// the new process gets the read end, the write end is closed by HandOver, or when this process exits
+	handoverReader, handoverWriter, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "create handover pipe error")
+	}
+	files = append(files, handoverReader)
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		restartEnv+"="+strconv.Itoa(os.Getpid()),
+		handoverEnv+"="+strconv.Itoa(listenFDsStart+len(names)),
+	)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		handoverWriter.Close()
+		return errors.Wrap(err, "start new process error")
+	}
+	listeners.HandOver()
+	listeners.handover = handoverWriter
+	fmt.Printf("[RESTART]: Listeners handed over to process %d\n", cmd.Process.Pid)
+
+	// the socket file belongs to the new process now, closing the listener must not remove it
+	for _, opened := range listeners.opened {
+		if unixListener, ok := opened.listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+// RestartOnHangup hands the listeners to a new process on SIGHUP, then calls stop to shut this one down.
+func (listeners *Listeners) RestartOnHangup(stop func()) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := listeners.Restart(); err != nil {
+				fmt.Println(errors.Wrap(err, "hot restart error"))
+				continue
+			}
+			signal.Stop(hangup)
+			stop()
+			return
+		}
+	}()
+}
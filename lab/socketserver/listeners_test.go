@@ -0,0 +1,91 @@
+package socketserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// childEnv makes the test binary act as the new process of a hot restart, see TestMain.
+const childEnv = "SOCKET_SERVER_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(childEnv) != "" {
+		os.Exit(runChild())
+	}
+	os.Exit(m.Run())
+}
+
+// runChild takes over the listener, waits for the handover and answers a single connection with its PID.
+func runChild() int {
+	listeners, err := InheritListeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	listeners.WaitHandover()
+	// nothing is listening on port 1, it's only opened if the listener wasn't inherited
+	listener, err := listeners.Listen("test", "tcp", "127.0.0.1:1")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer listener.Close()
+	listeners.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "child %d\n", os.Getpid())
+	return 0
+}
+
+func TestRestart(t *testing.T) {
+	listeners, err := InheritListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listeners.Listen("test", "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+
+	os.Setenv(childEnv, "1")
+	err = listeners.Restart()
+	os.Unsetenv(childEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// this process stops accepting, the listener stays open in the child
+	listener.Close()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("expected the listener to be open in the child: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// the child doesn't serve before the handover
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Fatalf("expected the child to wait for the handover, got %q", line)
+	}
+	listeners.HandOver()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("expected the child to serve after the handover: %v", err)
+	}
+	if !strings.HasPrefix(line, "child ") || line == fmt.Sprintf("child %d\n", os.Getpid()) {
+		t.Fatalf("expected the child to answer, got %q", line)
+	}
+}
@@ -0,0 +1,302 @@
+package socketserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Handler handles the connections of a server. Its methods are called one at a time,
+// from the goroutine of the server owning the sessions, so they don't need locking,
+// but they must not block.
+type Handler interface {
+	Connect(session *Session)
+	Frame(session *Session, frame []byte)
+	Disconnect(session *Session)
+}
+
+// ShutdownHandler is implemented by handlers with something to tell their sessions before the
+// server shuts down, frames sent from Shutdown are written before the connections are closed.
+// They are usually sent with SendControl.
+type ShutdownHandler interface {
+	Shutdown(session *Session)
+}
+
+// ControlWriter is implemented by frame writers that don't write the frames they're given as they are,
+// like a script, frames queued with SendControl go through WriteControl instead.
+type ControlWriter interface {
+	WriteControl(frame []byte) error
+}
+
+// Session is a connection to a client. Send, SendControl and Close may only be called from a Handler.
+type Session struct {
+	conn   net.Conn
+	reader FrameReader
+	writer FrameWriter
+	// out is owned by the server goroutine, which is the only one sending to and closing it
+	out chan outFrame
+	// closing is set by Close, frames read after it are ignored
+	closing bool
+	// Value is left to the handler, to keep its own state of the session
+	Value interface{}
+}
+
+func (session *Session) Conn() net.Conn {
+	return session.conn
+}
+
+type outFrame struct {
+	frame   []byte
+	control bool
+}
+
+type sessionFrame struct {
+	session *Session
+	frame   []byte
+}
+
+// Server runs a Handler over the connections accepted from a listener.
+type Server struct {
+	handler Handler
+	framing Framing
+	// QueueSize is how many frames can wait to be written to a session, slower sessions are closed
+	QueueSize int
+	// ShutdownTimeout is how long sessions get to receive what's queued when shutting down
+	ShutdownTimeout time.Duration
+
+	sessions     map[*Session]bool
+	connectCh    chan *Session
+	frameCh      chan sessionFrame
+	disconnectCh chan *Session
+	shutdownCh   chan time.Time
+	// done is closed once the server has shut down, nobody is listening on the channels after that
+	done chan struct{}
+	// connections tracks the receive and send goroutines of every session
+	connections sync.WaitGroup
+}
+
+func NewServer(handler Handler, framing Framing) *Server {
+	return &Server{
+		handler:         handler,
+		framing:         framing,
+		QueueSize:       64,
+		ShutdownTimeout: 5 * time.Second,
+		sessions:        make(map[*Session]bool),
+		connectCh:       make(chan *Session),
+		frameCh:         make(chan sessionFrame),
+		disconnectCh:    make(chan *Session),
+		shutdownCh:      make(chan time.Time),
+		done:            make(chan struct{}),
+	}
+}
+
+// Serve accepts connections from listener until ctx is done, then it stops accepting, gives the sessions
+// until ShutdownTimeout to receive what's queued, and closes everything.
+// It returns nil after a shutdown caused by ctx.
+func (server *Server) Serve(ctx context.Context, listener net.Listener) error {
+	go server.start()
+
+	fmt.Println("[WAITING]")
+	err := Accept(ctx, listener, server.open)
+
+	fmt.Println("[SHUTDOWN]: Server shutting down...")
+	server.shutdown(time.Now().Add(server.ShutdownTimeout))
+	server.connections.Wait()
+	fmt.Println("[SHUTDOWN]: Server stopped")
+	return err
+}
+
+func (server *Server) start() {
+	for {
+		select {
+		case session := <-server.connectCh:
+			server.sessions[session] = true
+			fmt.Println("[REGISTERED]: Client registered!")
+			server.handler.Connect(session)
+		case frame := <-server.frameCh:
+			if server.sessions[frame.session] && !frame.session.closing {
+				server.handler.Frame(frame.session, frame.frame)
+			}
+		case session := <-server.disconnectCh:
+			server.close(session)
+		case deadline := <-server.shutdownCh:
+			shutdownHandler, _ := server.handler.(ShutdownHandler)
+			for session := range server.sessions {
+				// stop reading new frames, what's queued already is still written until the deadline
+				session.conn.SetReadDeadline(time.Now())
+				session.conn.SetWriteDeadline(deadline)
+				if shutdownHandler != nil {
+					shutdownHandler.Shutdown(session)
+				}
+				server.close(session)
+			}
+			close(server.done)
+			fmt.Println("[SHUTDOWN]: Session manager stopped")
+			return
+		}
+	}
+}
+
+func (server *Server) shutdown(deadline time.Time) {
+	select {
+	case server.shutdownCh <- deadline:
+	case <-server.done:
+	}
+	<-server.done
+}
+
+// close forgets the session, the send goroutine closes the connection once what's queued is written.
+func (server *Server) close(session *Session) {
+	if !server.sessions[session] {
+		return
+	}
+	delete(server.sessions, session)
+	server.handler.Disconnect(session)
+	close(session.out)
+	fmt.Println("[UNREGISTERED]: Client unregistered!")
+}
+
+// Send queues frame to be written to the session, the session is closed if it's too slow to keep up.
+func (session *Session) Send(frame []byte) {
+	session.send(outFrame{frame: frame})
+}
+
+// SendControl is Send for what the server says itself, like a goodbye, it's written as it is
+// by writers transforming the other frames.
+func (session *Session) SendControl(frame []byte) {
+	session.send(outFrame{frame: frame, control: true})
+}
+
+func (session *Session) send(frame outFrame) {
+	select {
+	case session.out <- frame:
+	default:
+		fmt.Println("[SLOW]: Client too slow, disconnecting")
+		// the write is refused right away instead of waiting for the queue to drain
+		session.conn.SetWriteDeadline(time.Now())
+		session.Close()
+	}
+}
+
+// Close closes the session, frames queued already are still written.
+func (session *Session) Close() {
+	session.closing = true
+	// the receive goroutine reports the read error, which closes the session in the server goroutine
+	session.conn.SetReadDeadline(time.Now())
+}
+
+func (server *Server) open(conn net.Conn) {
+	session := &Session{
+		conn:   conn,
+		reader: server.framing.NewReader(conn),
+		writer: server.framing.NewWriter(conn),
+		out:    make(chan outFrame, server.QueueSize),
+	}
+	select {
+	case server.connectCh <- session:
+	case <-server.done:
+		conn.Close()
+		return
+	}
+	server.connections.Add(2)
+	go func() {
+		defer server.connections.Done()
+		server.receive(session)
+	}()
+	go func() {
+		defer server.connections.Done()
+		server.send(session)
+	}()
+}
+
+func (server *Server) receive(session *Session) {
+	defer func() {
+		select {
+		case server.disconnectCh <- session:
+		case <-server.done:
+		}
+	}()
+
+	for {
+		frame, err := session.reader.ReadFrame()
+		if err != nil {
+			if !IsClosed(err) {
+				fmt.Println(errors.Wrap(err, "read frame error"))
+			}
+			return
+		}
+		select {
+		case server.frameCh <- sessionFrame{session: session, frame: frame}:
+		case <-server.done:
+			return
+		}
+	}
+}
+
+func (server *Server) send(session *Session) {
+	defer session.conn.Close()
+	controlWriter, _ := session.writer.(ControlWriter)
+	for out := range session.out {
+		var err error
+		if out.control && controlWriter != nil {
+			err = controlWriter.WriteControl(out.frame)
+		} else {
+			err = session.writer.WriteFrame(out.frame)
+		}
+		if err != nil {
+			if !IsClosed(err) {
+				fmt.Println(errors.Wrap(err, "write frame error"))
+			}
+			session.conn.Close()
+			// keep draining until the server closes the session
+			for range session.out {
+			}
+			return
+		}
+	}
+}
+
+// IsClosed tells whether err only means the connection is gone, closed by either side or timed out.
+func IsClosed(err error) bool {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	netErr, ok := errors.Cause(err).(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Accept accepts connections from listener and passes them to handle until ctx is done,
+// handle is called from the accepting goroutine, so it should start its own for anything slow.
+// The listener is closed when Accept returns, which is with nil after ctx is done.
+func Accept(ctx context.Context, listener net.Listener, handle func(conn net.Conn)) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-stopped:
+		}
+	}()
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				fmt.Println(errors.Wrap(err, "accept connection error"))
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return errors.Wrap(err, "accept connection error")
+		}
+		handle(conn)
+	}
+}
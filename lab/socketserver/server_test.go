@@ -0,0 +1,166 @@
+package socketserver
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	*Server
+	address string
+	stop    context.CancelFunc
+	// stopped gets what Serve returned
+	stopped chan error
+}
+
+func startServer(t *testing.T, handler Handler) *testServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testServer{
+		Server:  NewServer(handler, Lines(1024)),
+		address: listener.Addr().String(),
+		stopped: make(chan error, 1),
+	}
+	server.ShutdownTimeout = time.Second
+	ctx, stop := context.WithCancel(context.Background())
+	server.stop = stop
+	go func() { server.stopped <- server.Serve(ctx, listener) }()
+	t.Cleanup(func() {
+		stop()
+		<-server.stopped
+	})
+	return server
+}
+
+func dial(t *testing.T, server *testServer) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// waitStopped waits for Serve to return, it must be nil after a shutdown.
+func waitStopped(t *testing.T, server *testServer) {
+	t.Helper()
+	select {
+	case err := <-server.stopped:
+		if err != nil {
+			t.Fatalf("expected Serve to return nil, got %v", err)
+		}
+		server.stopped <- err
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve didn't return")
+	}
+}
+
+func TestServerEcho(t *testing.T) {
+	server := startServer(t, Echo())
+	conn, reader := dial(t, server)
+	if _, err := conn.Write([]byte("hello\r\nworld\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"hello\n", "world\n"} {
+		if line, err := reader.ReadString('\n'); err != nil || line != expected {
+			t.Fatalf("expected %q, got %q, %v", expected, line, err)
+		}
+	}
+
+	server.stop()
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	waitStopped(t, server)
+	if conn, err := net.Dial("tcp", server.address); err == nil {
+		conn.Close()
+		t.Fatal("expected the listener to be closed")
+	}
+}
+
+func TestServerRequestResponse(t *testing.T) {
+	server := startServer(t, RequestResponse(func(request []byte) []byte {
+		if string(request) == "ping" {
+			return []byte("pong")
+		}
+		return nil
+	}))
+	conn, reader := dial(t, server)
+	if _, err := conn.Write([]byte("ignored\nping\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := reader.ReadString('\n'); err != nil || line != "pong\n" {
+		t.Fatalf("expected only the answer to ping, got %q, %v", line, err)
+	}
+}
+
+func TestServerBroadcast(t *testing.T) {
+	server := startServer(t, Broadcast())
+	alice, aliceReader := dial(t, server)
+	expect := func(reader *bufio.Reader, expected string) {
+		t.Helper()
+		if line, err := reader.ReadString('\n'); err != nil || line != expected {
+			t.Fatalf("expected %q, got %q, %v", expected, line, err)
+		}
+	}
+	// a session is only registered for sure once it gets its own frame back
+	alice.Write([]byte("alice\n"))
+	expect(aliceReader, "alice\n")
+	bob, bobReader := dial(t, server)
+	bob.Write([]byte("bob\n"))
+	expect(bobReader, "bob\n")
+	expect(aliceReader, "bob\n")
+
+	// the sessions left are not written to anymore
+	bob.Close()
+	carol, carolReader := dial(t, server)
+	carol.Write([]byte("carol\n"))
+	expect(carolReader, "carol\n")
+	expect(aliceReader, "carol\n")
+	alice.Write([]byte("bye\n"))
+	expect(aliceReader, "bye\n")
+	expect(carolReader, "bye\n")
+}
+
+// goodbyeHandler echoes, and says goodbye when the server shuts down.
+type goodbyeHandler struct {
+	Handler
+}
+
+func (goodbyeHandler) Shutdown(session *Session) {
+	session.Send([]byte("goodbye"))
+}
+
+func TestServerShutdownHandler(t *testing.T) {
+	server := startServer(t, goodbyeHandler{Handler: Echo()})
+	conns := make([]*bufio.Reader, 3)
+	for i := range conns {
+		conn, reader := dial(t, server)
+		// the session is only registered for sure once it answers
+		conn.Write([]byte("hello\n"))
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = reader
+	}
+
+	server.stop()
+	for _, reader := range conns {
+		if line, err := reader.ReadString('\n'); err != nil || line != "goodbye\n" {
+			t.Fatalf("expected a goodbye before the connection is closed, got %q, %v", line, err)
+		}
+		if _, err := reader.ReadString('\n'); err != io.EOF {
+			t.Fatalf("expected the connection to be closed, got %v", err)
+		}
+	}
+	waitStopped(t, server)
+}
@@ -0,0 +1,130 @@
+// certgen generates a throwaway CA, a server certificate and client certificates signed by it,
+// to try the TLS mode locally. Never use them for anything else.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spongeprojects/magicconch"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type issued struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func main() {
+	dir := flag.String("dir", "certs", "directory to write the certificates and keys to")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma-separated host names and IPs of the server certificate")
+	serverName := flag.String("server-name", "server", "common name of the server certificate, which has to be the -server-id of the server when it links to peers")
+	clients := flag.String("clients", "alice,bob", "comma-separated common names of the client certificates, which become their nicknames")
+	validFor := flag.Duration("valid-for", 30*24*time.Hour, "how long the certificates are valid")
+	flag.Parse()
+
+	magicconch.Must(os.MkdirAll(*dir, 0700))
+
+	notAfter := time.Now().Add(*validFor)
+	ca, err := issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "unix-socket-broadcast lab CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		NotAfter:              notAfter,
+	}, nil)
+	magicconch.Must(err)
+	magicconch.Must(write(*dir, "ca", ca))
+
+	server := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: *serverName},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		// servers present it to each other too when they link
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		NotAfter:    notAfter,
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else if host != "" {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	serverIssued, err := issue(server, ca)
+	magicconch.Must(err)
+	magicconch.Must(write(*dir, "server", serverIssued))
+
+	for _, name := range strings.Split(*clients, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		client, err := issue(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			NotAfter:    notAfter,
+		}, ca)
+		magicconch.Must(err)
+		magicconch.Must(write(*dir, name, client))
+	}
+
+	fmt.Println("[GENERATED]: Certificates written to " + *dir)
+}
+
+// issue creates a key and a certificate from template signed by parent, or self-signed if parent is nil.
+func issue(template *x509.Certificate, parent *issued) (*issued, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate key error")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "generate serial number error")
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Minute)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "create certificate error")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse certificate error")
+	}
+	return &issued{cert: cert, key: key}, nil
+}
+
+// write saves the certificate as <name>.pem and the key as <name>-key.pem.
+func write(dir, name string, issued *issued) error {
+	keyDER, err := x509.MarshalECPrivateKey(issued.key)
+	if err != nil {
+		return errors.Wrap(err, "marshal key error")
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issued.cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644); err != nil {
+		return errors.Wrap(err, "write certificate error")
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		return errors.Wrap(err, "write key error")
+	}
+	return nil
+}
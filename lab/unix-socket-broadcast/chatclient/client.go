@@ -0,0 +1,373 @@
+// Package chatclient is a client for the broadcast server that survives disconnections:
+// it reconnects with exponential backoff, queues what's sent while offline,
+// and picks up where it left off once it's back.
+package chatclient
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	StateConnecting   State = "connecting"
+	StateConnected    State = "connected"
+	StateDisconnected State = "disconnected"
+	// StateClosed is final, the client quit or its context is done.
+	StateClosed State = "closed"
+)
+
+var (
+	ErrQueueFull = errors.New("offline queue full")
+	ErrClosed    = errors.New("client closed")
+)
+
+type Options struct {
+	Network string
+	Address string
+	// Dial connects to the server, it defaults to net.Dialer
+	Dial         func(ctx context.Context, network, address string) (net.Conn, error)
+	Framing      protocol.Framing
+	MaxFrameSize int
+	// MinBackoff is the first wait before reconnecting, doubled after every failed attempt up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ServerTimeout gives up on a connection the server sent nothing on for this long, 0 means never
+	ServerTimeout time.Duration
+	// QueueSize is how many messages can be queued while offline
+	QueueSize int
+	// OnStateChange is called with the error that caused a disconnection, if any
+	OnStateChange func(state State, err error)
+	// OnMessage is called for every message but pings, never concurrently
+	OnMessage func(message *protocol.Message)
+}
+
+type Client struct {
+	options Options
+
+	mu     sync.Mutex
+	state  State
+	writer *protocol.Writer
+	// queue holds what's sent while offline, flushed on reconnect
+	queue [][]byte
+	// lastSeq is the last topic message seen, to ask for the missed ones after reconnecting
+	lastSeq uint64
+	// seen has the sequence numbers of recent messages, replays after reconnecting overlap
+	seen map[uint64]bool
+	// nick and patterns are replayed on reconnect, the server forgets them with the connection
+	nick     string
+	patterns map[string]bool
+	quitting bool
+}
+
+func New(options Options) *Client {
+	if options.Dial == nil {
+		dialer := &net.Dialer{}
+		options.Dial = dialer.DialContext
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = 500 * time.Millisecond
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = 30 * time.Second
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = 100
+	}
+	return &Client{
+		options:  options,
+		state:    StateDisconnected,
+		patterns: map[string]bool{protocol.DefaultTopic: true},
+		seen:     make(map[uint64]bool),
+	}
+}
+
+func (client *Client) State() State {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.state
+}
+
+func (client *Client) LastSeq() uint64 {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.lastSeq
+}
+
+func (client *Client) setState(state State, err error) {
+	client.mu.Lock()
+	changed := client.state != state
+	client.state = state
+	client.mu.Unlock()
+	if changed && client.options.OnStateChange != nil {
+		client.options.OnStateChange(state, err)
+	}
+}
+
+// Send sends a line of text, a message or a command, queueing it if the client is offline.
+// The lock isn't held while writing, a slow connection doesn't hold up the rest of the client.
+func (client *Client) Send(text string) error {
+	frame := []byte(text)
+
+	client.mu.Lock()
+	if client.state == StateClosed {
+		client.mu.Unlock()
+		return ErrClosed
+	}
+	client.track(text)
+	writer := client.writer
+	client.mu.Unlock()
+
+	for {
+		if writer != nil {
+			err := writer.WriteFrame(frame)
+			if err == nil {
+				return nil
+			}
+			if errors.Cause(err) == protocol.ErrFrameTooLarge || errors.Cause(err) == protocol.ErrInvalidFrame {
+				return err
+			}
+			// the connection is dying, the receive loop will notice, keep the message for the next one
+		}
+
+		client.mu.Lock()
+		if client.writer != nil && client.writer != writer {
+			// a new connection came up meanwhile, its queue was flushed already
+			writer = client.writer
+			client.mu.Unlock()
+			continue
+		}
+		defer client.mu.Unlock()
+		if len(client.queue) >= client.options.QueueSize {
+			return ErrQueueFull
+		}
+		client.queue = append(client.queue, frame)
+		return nil
+	}
+}
+
+// track remembers the commands that need to be replayed on a new connection.
+func (client *Client) track(text string) {
+	command, ok := protocol.ParseCommand(text)
+	if !ok {
+		return
+	}
+	arg, _ := protocol.SplitArg(command.Args)
+	switch command.Name {
+	case protocol.CommandNick:
+		client.nick = arg
+	case protocol.CommandSubscribe:
+		client.patterns[arg] = true
+	case protocol.CommandUnsubscribe:
+		delete(client.patterns, arg)
+	case protocol.CommandQuit:
+		client.quitting = true
+	}
+}
+
+// Run keeps the client connected until ctx is done or "/quit" is sent.
+func (client *Client) Run(ctx context.Context) error {
+	backoff := client.options.MinBackoff
+	for {
+		client.setState(StateConnecting, nil)
+		conn, err := client.options.Dial(ctx, client.options.Network, client.options.Address)
+		if err == nil {
+			backoff = client.options.MinBackoff
+			err = client.session(ctx, conn)
+		}
+
+		client.mu.Lock()
+		quitting := client.quitting
+		client.mu.Unlock()
+		if ctx.Err() != nil {
+			// the error is only the connection being closed
+			client.setState(StateClosed, nil)
+			return ctx.Err()
+		}
+		if quitting {
+			client.setState(StateClosed, err)
+			return nil
+		}
+		client.setState(StateDisconnected, err)
+
+		// jitter keeps a crowd of clients from coming back all at once
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			client.setState(StateClosed, nil)
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > client.options.MaxBackoff {
+			backoff = client.options.MaxBackoff
+		}
+	}
+}
+
+// session serves a connection until it fails.
+func (client *Client) session(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	reader := protocol.NewReader(conn, client.options.Framing, client.options.MaxFrameSize)
+	writer := protocol.NewWriter(conn, client.options.Framing, client.options.MaxFrameSize)
+	if err := client.resume(writer); err != nil {
+		return err
+	}
+	client.setState(StateConnected, nil)
+	defer func() {
+		client.mu.Lock()
+		client.writer = nil
+		client.mu.Unlock()
+	}()
+
+	// the welcome notice comes first, it tells if the server started over since the last session
+	var welcome *protocol.Message
+	first := true
+	for {
+		if client.options.ServerTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(client.options.ServerTimeout))
+		}
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("server closed the connection")
+			}
+			return err
+		}
+		message, err := protocol.UnmarshalMessage(frame)
+		if err != nil {
+			return err
+		}
+		if message.Kind == protocol.KindPing {
+			if err := writer.WriteFrame([]byte("/" + protocol.CommandPong + " " + message.Body)); err != nil {
+				return errors.Wrap(err, "send pong error")
+			}
+			continue
+		}
+		if first {
+			first = false
+			if message.Kind == protocol.KindNotice {
+				welcome = message
+			}
+		}
+		// it's only acted upon once the session is really on, a refused connection gets a notice too
+		if welcome != nil && message.Seq > 0 {
+			if client.restarted(welcome.LastSeq) {
+				if err := writer.WriteFrame([]byte("/" + protocol.CommandHistory + " 0")); err != nil {
+					return errors.Wrap(err, "request history error")
+				}
+			}
+			welcome = nil
+		}
+		if !client.see(message) {
+			continue
+		}
+		if client.options.OnMessage != nil {
+			client.options.OnMessage(message)
+		}
+	}
+}
+
+// resume restores the nickname and subscriptions on a new connection, asks for what was missed,
+// and flushes the offline queue. Nothing else is written until it's done.
+func (client *Client) resume(writer *protocol.Writer) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	var frames []string
+	if client.nick != "" {
+		frames = append(frames, "/"+protocol.CommandNick+" "+client.nick)
+	}
+	var patterns []string
+	for pattern := range client.patterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		// the default topic is subscribed by the server on join
+		if pattern != protocol.DefaultTopic {
+			frames = append(frames, "/"+protocol.CommandSubscribe+" "+pattern)
+		}
+	}
+	if !client.patterns[protocol.DefaultTopic] {
+		frames = append(frames, "/"+protocol.CommandUnsubscribe+" "+protocol.DefaultTopic)
+	}
+	if client.lastSeq > 0 {
+		frames = append(frames, "/"+protocol.CommandHistory+" "+strconv.FormatUint(client.lastSeq, 10))
+	}
+	for _, frame := range frames {
+		if err := writer.WriteFrame([]byte(frame)); err != nil {
+			return errors.Wrap(err, "resume session error")
+		}
+	}
+
+	for len(client.queue) > 0 {
+		if err := writer.WriteFrame(client.queue[0]); err != nil {
+			return errors.Wrap(err, "flush offline queue error")
+		}
+		client.queue = client.queue[1:]
+	}
+	client.writer = writer
+	return nil
+}
+
+// restarted forgets the sequence numbers seen if the server is behind them, it started over
+// without its message log and numbers messages from 1 again. It returns true if it did.
+func (client *Client) restarted(lastSeq uint64) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if lastSeq >= client.lastSeq {
+		return false
+	}
+	client.lastSeq = 0
+	client.seen = make(map[uint64]bool)
+	return true
+}
+
+// seenWindow is how far behind the last sequence number duplicates are still detected.
+const seenWindow = 4096
+
+// see records the sequence number of a message, it returns false for one seen already.
+// After reconnecting the server replays the recent messages before answering "/history",
+// so messages may come out of order and overlap.
+func (client *Client) see(message *protocol.Message) bool {
+	if message.Seq == 0 {
+		return true
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.seen[message.Seq] || message.Seq+seenWindow <= client.lastSeq {
+		return false
+	}
+	client.seen[message.Seq] = true
+	if message.Seq > client.lastSeq {
+		client.lastSeq = message.Seq
+	}
+	if len(client.seen) > 2*seenWindow {
+		for seq := range client.seen {
+			if seq+seenWindow <= client.lastSeq {
+				delete(client.seen, seq)
+			}
+		}
+	}
+	return true
+}
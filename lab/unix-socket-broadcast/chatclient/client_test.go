@@ -0,0 +1,244 @@
+package chatclient
+
+import (
+	"context"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeSession accepts a connection, sends it a welcome and messages, and returns what the client sent
+// until it stops sending for a while.
+func fakeSession(t *testing.T, listener net.Listener, lastSeq uint64, messages []*protocol.Message) []string {
+	t.Helper()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writer := protocol.NewWriter(conn, protocol.FramingLength, 0)
+	reader := protocol.NewReader(conn, protocol.FramingLength, 0)
+
+	welcome := &protocol.Message{Kind: protocol.KindNotice, Time: time.Now(), Body: "welcome", LastSeq: lastSeq}
+	for _, message := range append([]*protocol.Message{welcome}, messages...) {
+		frame, err := message.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var received []string
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			return received
+		}
+		received = append(received, string(frame))
+	}
+}
+
+func topicMessage(seq uint64, body string) *protocol.Message {
+	return &protocol.Message{Kind: protocol.KindMessage, Seq: seq, Time: time.Now(), Topic: protocol.DefaultTopic, Body: body}
+}
+
+func TestServerStartedOver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	bodies := make(chan string, 16)
+	client := New(Options{
+		Network:    "tcp",
+		Address:    listener.Addr().String(),
+		Framing:    protocol.FramingLength,
+		MinBackoff: 10 * time.Millisecond,
+		OnMessage: func(message *protocol.Message) {
+			if message.Kind == protocol.KindMessage {
+				bodies <- message.Body
+			}
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	fakeSession(t, listener, 0, []*protocol.Message{topicMessage(1, "one"), topicMessage(2, "two"), topicMessage(3, "three")})
+	for _, expected := range []string{"one", "two", "three"} {
+		if body := <-bodies; body != expected {
+			t.Fatalf("expected %q, got %q", expected, body)
+		}
+	}
+	if client.LastSeq() != 3 {
+		t.Fatalf("expected last seq 3, got %d", client.LastSeq())
+	}
+
+	// the server comes back without its log, numbering from 1 again
+	sent := fakeSession(t, listener, 0, []*protocol.Message{topicMessage(1, "after restart")})
+	select {
+	case body := <-bodies:
+		if body != "after restart" {
+			t.Fatalf("expected the first message after the restart, got %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the first message after the restart was dropped as a duplicate")
+	}
+	if client.LastSeq() != 1 {
+		t.Fatalf("expected last seq 1 after the restart, got %d", client.LastSeq())
+	}
+	var askedAgain bool
+	for _, frame := range sent {
+		if frame == "/history 0" {
+			askedAgain = true
+		}
+	}
+	if !askedAgain {
+		t.Fatalf("expected the client to ask for the whole history again, it sent %q", sent)
+	}
+}
+
+func TestServerDidNotStartOver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	bodies := make(chan string, 16)
+	client := New(Options{
+		Network:    "tcp",
+		Address:    listener.Addr().String(),
+		Framing:    protocol.FramingLength,
+		MinBackoff: 10 * time.Millisecond,
+		OnMessage: func(message *protocol.Message) {
+			if message.Kind == protocol.KindMessage {
+				bodies <- message.Body
+			}
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	fakeSession(t, listener, 0, []*protocol.Message{topicMessage(1, "one"), topicMessage(2, "two")})
+	<-bodies
+	<-bodies
+
+	// the recent messages are replayed on join, the ones seen already are dropped
+	replayed := topicMessage(2, "two")
+	replayed.History = true
+	fakeSession(t, listener, 2, []*protocol.Message{replayed, topicMessage(3, "three")})
+	if body := <-bodies; body != "three" {
+		t.Fatalf("expected only the new message, got %q", body)
+	}
+}
+
+// stalledConn fails the writes made once it's stalled, when it's released.
+type stalledConn struct {
+	net.Conn
+	stalled  chan struct{}
+	released chan struct{}
+}
+
+func (conn *stalledConn) Write(p []byte) (int, error) {
+	select {
+	case <-conn.stalled:
+		<-conn.released
+		return 0, net.ErrClosed
+	default:
+		return conn.Conn.Write(p)
+	}
+}
+
+// a message whose write fails while the client reconnects goes out on the new connection.
+func TestSendWhileReconnecting(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	first := &stalledConn{stalled: make(chan struct{}), released: make(chan struct{})}
+	dials := 0
+	states := make(chan State, 16)
+	client := New(Options{
+		Network: "tcp",
+		Address: listener.Addr().String(),
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+			if dials++; dials == 1 && err == nil {
+				first.Conn = conn
+				return first, nil
+			}
+			return conn, err
+		},
+		Framing:    protocol.FramingLength,
+		MinBackoff: 10 * time.Millisecond,
+		OnStateChange: func(state State, err error) {
+			states <- state
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState := func(expected State) {
+		t.Helper()
+		for state := range states {
+			if state == expected {
+				return
+			}
+		}
+	}
+	waitState(StateConnected)
+
+	// the write is stuck on the first connection while the client reconnects
+	close(first.stalled)
+	sent := make(chan error, 1)
+	go func() { sent <- client.Send("late") }()
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	go func() {
+		waitState(StateDisconnected)
+		waitState(StateConnected)
+		close(first.released)
+	}()
+
+	received := fakeSession(t, listener, 0, nil)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0] != "late" {
+		t.Fatalf("expected the message on the new connection, got %q", received)
+	}
+}
@@ -1,58 +1,136 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/spongeprojects/magicconch"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/chatclient"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/tlsconfig"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
-type Client struct {
-	socket net.Conn
-}
+// sendCommand sends a file, like "/send bob report.pdf", it's handled by the client, not the server.
+const sendCommand = "send"
 
-func (client *Client) receive() {
-	defer func(socket net.Conn) {
-		err := socket.Close()
-		if err != nil {
-			fmt.Println(errors.Wrap(err, "close socket error"))
-		}
-	}(client.socket)
+func main() {
+	framingFlag := flag.String("framing", string(protocol.FramingLength), "message framing: length or line")
+	maxFrameSize := flag.Int("max-frame-size", protocol.DefaultMaxFrameSize, "max size of a single message in bytes")
+	network := flag.String("network", "tcp", "network to connect to: tcp or unix")
+	address := flag.String("address", "localhost:12345", "address to connect to, a file path for unix")
+	serverTimeout := flag.Duration("server-timeout", time.Minute, "give up on a server that sent nothing, pings included, for this long, 0 means never")
+	minBackoff := flag.Duration("min-backoff", 500*time.Millisecond, "first wait before reconnecting, doubled after every failed attempt")
+	maxBackoff := flag.Duration("max-backoff", 30*time.Second, "longest wait before reconnecting")
+	queueSize := flag.Int("queue-size", 100, "max number of messages queued while disconnected")
+	useTLS := flag.Bool("tls", false, "connect over TLS, implied by the other -tls flags")
+	tlsCA := flag.String("tls-ca", "", "CA file to verify the server certificate with, the system roots if empty")
+	tlsCert := flag.String("tls-cert", "", "client certificate file, for servers requiring one")
+	tlsKey := flag.String("tls-key", "", "client private key file")
+	tlsServerName := flag.String("tls-server-name", "", "name to verify the server certificate against, the host of -address if empty, localhost for unix")
+	downloads := flag.String("downloads", "downloads", "directory to save the files received in")
+	acceptFilesFrom := flag.String("accept-files-from", "", "comma-separated nicknames to accept files from, * for anybody, files are refused if empty")
+	maxFileSize := flag.Int64("max-file-size", 100*1024*1024, "largest file in bytes accepted, 0 means no limit")
+	uiFlag := flag.String("ui", "auto", "user interface: tui, plain, or auto for tui when both stdin and stdout are terminals")
+	wantTimeout := flag.Duration("want-timeout", 3*time.Second, "how long \"/send\" waits for the recipients to tell how much of a file they have already")
+	flag.Parse()
 
-	for {
-		message := make([]byte, 4096)
-		length, err := client.socket.Read(message)
-		if err != nil {
-			break
-		}
-		if length > 0 {
-			fmt.Println("[RECEIVED]: " + string(message))
+	framing, err := protocol.ParseFraming(*framingFlag)
+	magicconch.Must(err)
+
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+	if *useTLS || *tlsCA != "" || *tlsCert != "" || *tlsServerName != "" {
+		serverName := *tlsServerName
+		if serverName == "" && *network == "unix" {
+			serverName = "localhost"
+		} else if serverName == "" {
+			serverName, _, err = net.SplitHostPort(*address)
+			magicconch.Must(err)
 		}
+		tlsConfig, err := tlsconfig.Client(*tlsCA, *tlsCert, *tlsKey, serverName)
+		magicconch.Must(err)
+		dialer := &tls.Dialer{Config: tlsConfig}
+		dial = dialer.DialContext
 	}
-}
 
-func main() {
-	fmt.Println("Starting client...")
+	if *uiFlag != "tui" && *uiFlag != "plain" && *uiFlag != "auto" {
+		magicconch.Must(errors.Errorf("unknown ui %q", *uiFlag))
+	}
+	var ui UI = plainUI{}
+	if *uiFlag == "tui" || *uiFlag == "auto" && isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		terminal, err := NewTerminal(os.Stdin, os.Stdout, *network+" "+*address)
+		magicconch.Must(err)
+		defer terminal.Close()
+		ui = terminal
+	}
 
-	conn, err := net.Dial("tcp", "localhost:12345")
-	magicconch.Must(err)
+	fmt.Fprintln(ui, "Starting client...")
+
+	var transfers *Transfers
+	client := chatclient.New(chatclient.Options{
+		Network:       *network,
+		Address:       *address,
+		Dial:          dial,
+		Framing:       framing,
+		MaxFrameSize:  *maxFrameSize,
+		MinBackoff:    *minBackoff,
+		MaxBackoff:    *maxBackoff,
+		ServerTimeout: *serverTimeout,
+		QueueSize:     *queueSize,
+		OnStateChange: ui.SetState,
+		OnMessage: func(message *protocol.Message) {
+			if message.Kind == protocol.KindFile {
+				transfers.Receive(message)
+				return
+			}
+			ui.Show(message)
+		},
+	})
+	transfers = NewTransfers(client, ui, *downloads, *wantTimeout)
+	transfers.MaxSize = *maxFileSize
+	for _, nick := range strings.Split(*acceptFilesFrom, ",") {
+		if nick = strings.TrimSpace(nick); nick != "" {
+			transfers.AcceptFrom[nick] = true
+		}
+	}
 
-	client := &Client{socket: conn}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	go client.receive()
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		client.Run(ctx)
+	}()
 
-	fmt.Println("[WAITING]")
-	for {
-		reader := bufio.NewReader(os.Stdin)
-		message, _ := reader.ReadString('\n')
-		message = strings.Trim(message, "\n")
-		fmt.Println("[SENDING]: " + message)
-		_, err := conn.Write([]byte(message))
-		if err != nil {
-			fmt.Println(errors.Wrap(err, "send message error"))
-		}
+	uiDone := make(chan struct{})
+	go func() {
+		defer close(uiDone)
+		ui.Run(ctx, func(line string) {
+			if command, ok := protocol.ParseCommand(line); ok && command.Name == sendCommand {
+				target, path := protocol.SplitArg(command.Args)
+				if target == "" || path == "" {
+					fmt.Fprintln(ui, "usage: /"+sendCommand+" <nick|#topic> <path>")
+				} else if err := transfers.Send(target, path); err != nil {
+					fmt.Fprintln(ui, errors.Wrap(err, "send file error"))
+				}
+				return
+			}
+			if err := client.Send(line); err != nil {
+				fmt.Fprintln(ui, errors.Wrap(err, "send message error"))
+			}
+		})
+	}()
+
+	select {
+	case <-runDone:
+	case <-uiDone:
 	}
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"strings"
+)
+
+const timeFormat = "15:04:05"
+
+// render formats a message from the server as a line of chat, like "[15:04:05] <bob> hello",
+// decorate dresses up the nicknames in it. Nothing from the server can be trusted with
+// escape sequences, nicknames included, and only the body of a message can span lines.
+func render(message *protocol.Message, decorate func(string) string) string {
+	nick := func(name string) string {
+		return decorate(sanitizeLine(name))
+	}
+	from := nick("unknown")
+	if message.From != nil {
+		from = nick(message.From.String())
+	}
+	topic := ""
+	if message.Topic != "" && message.Topic != protocol.DefaultTopic {
+		topic = "#" + sanitizeLine(message.Topic) + " "
+	}
+	body := sanitize(message.Body)
+	prefix := "[" + message.Time.Local().Format(timeFormat) + "] "
+	if message.History {
+		prefix += "(history) "
+	}
+
+	switch message.Kind {
+	case protocol.KindMessage:
+		return prefix + topic + "<" + from + "> " + body
+	case protocol.KindAction:
+		return prefix + topic + "* " + from + " " + body
+	case protocol.KindDirect:
+		return prefix + "<" + from + " -> " + nick(message.To) + "> " + body
+	case protocol.KindJoin:
+		return prefix + "--> " + from + " joined"
+	case protocol.KindLeave:
+		if message.Body != "" {
+			return prefix + "<-- " + from + " left (" + sanitizeLine(message.Body) + ")"
+		}
+		return prefix + "<-- " + from + " left"
+	case protocol.KindNick:
+		return prefix + "-- " + sanitizeLine(message.Body) + " is now known as " + from
+	case protocol.KindNotice:
+		return prefix + "-!- " + body
+	}
+	return prefix + fmt.Sprintf("(%s) <%s> %s", sanitizeLine(string(message.Kind)), from, body)
+}
+
+// sanitize makes control characters visible, but newlines, so they can't move the cursor around.
+// C1 controls are included, some terminals take U+009B as the start of an escape sequence.
+func sanitize(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return r
+		}
+		if r == '\t' {
+			return ' '
+		}
+		if r < ' ' || r >= 0x7f && r <= 0x9f {
+			return '?'
+		}
+		return r
+	}, text)
+}
+
+// sanitizeLine is sanitize for what has to stay on a single line.
+func sanitizeLine(text string) string {
+	return strings.ReplaceAll(sanitize(text), "\n", "?")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderSanitizes(t *testing.T) {
+	evil := "\x1b[2J\x9b2J\x07\n"
+	for _, message := range []*protocol.Message{
+		{Kind: protocol.KindMessage, Topic: "news" + evil, From: &protocol.Identity{Nick: "mallory" + evil}, Body: "hello" + evil + "world"},
+		{Kind: protocol.KindDirect, From: &protocol.Identity{Nick: "mallory"}, To: "bob" + evil, Body: "hi"},
+		{Kind: protocol.KindLeave, From: &protocol.Identity{Nick: "mallory"}, Body: "bye" + evil},
+		{Kind: protocol.KindNick, From: &protocol.Identity{Nick: "mallory"}, Body: "alice" + evil},
+		{Kind: protocol.Kind("odd" + evil), Body: "hi"},
+	} {
+		message.Time = time.Now()
+		line := render(message, plainNick)
+		if strings.ContainsAny(line, "\x1b\x07\u009b") {
+			t.Fatalf("expected control characters to be replaced, got %q", line)
+		}
+		lines := 1
+		if message.Kind == protocol.KindMessage {
+			lines = 2
+		}
+		if strings.Count(line, "\n") != lines-1 {
+			t.Fatalf("expected only the body to span lines, got %q", line)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	if got := sanitize("a\tb\x1bc\u0085d\u009fe f\ng"); got != "a b?c?d?e f\ng" {
+		t.Fatalf("unexpected sanitized text %q", got)
+	}
+	if got := sanitizeLine("a\nb"); got != "a?b" {
+		t.Fatalf("unexpected sanitized line %q", got)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// resizeSignals tell the terminal changed size.
+var resizeSignals = []os.Signal{syscall.SIGWINCH}
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func isTerminal(file *os.File) bool {
+	var termios syscall.Termios
+	return ioctl(file.Fd(), syscall.TCGETS, unsafe.Pointer(&termios)) == nil
+}
+
+// makeRaw turns off line editing, echo and signals, like cfmakeraw(3), and returns how to undo it.
+func makeRaw(file *os.File) (func() error, error) {
+	var termios syscall.Termios
+	if err := ioctl(file.Fd(), syscall.TCGETS, unsafe.Pointer(&termios)); err != nil {
+		return nil, err
+	}
+	saved := termios
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	termios.Cflag |= syscall.CS8
+	termios.Cc[syscall.VMIN] = 1
+	termios.Cc[syscall.VTIME] = 0
+	if err := ioctl(file.Fd(), syscall.TCSETS, unsafe.Pointer(&termios)); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return ioctl(file.Fd(), syscall.TCSETS, unsafe.Pointer(&saved))
+	}, nil
+}
+
+func terminalSize(file *os.File) (width, height int, err error) {
+	var size struct {
+		rows, cols, xpixel, ypixel uint16
+	}
+	if err := ioctl(file.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&size)); err != nil {
+		return 0, 0, err
+	}
+	return int(size.cols), int(size.rows), nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"os"
+)
+
+var resizeSignals []os.Signal
+
+// isTerminal is only implemented on linux, everywhere else the client falls back to the plain UI.
+func isTerminal(*os.File) bool {
+	return false
+}
+
+func makeRaw(*os.File) (func() error, error) {
+	return nil, errors.New("the terminal UI is only supported on linux")
+}
+
+func terminalSize(*os.File) (width, height int, err error) {
+	return 0, 0, errors.New("the terminal UI is only supported on linux")
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/chatclient"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transfers sends files with "/send" and saves the files received in a directory.
+// Files being received are kept as ".<id>.part" there until they are complete and verified,
+// so a transfer interrupted on either side is resumed by sending the same file again.
+type Transfers struct {
+	// AcceptFrom are the nicknames files are accepted from, "*" accepts them from anybody
+	AcceptFrom map[string]bool
+	// MaxSize is the largest file accepted in bytes, 0 means no limit
+	MaxSize int64
+
+	client *chatclient.Client
+	// out shows how transfers go
+	out io.Writer
+	dir string
+	// wantTimeout is how long a sender waits for the recipients to tell how much they already have
+	wantTimeout time.Duration
+
+	mu       sync.Mutex
+	outgoing map[string]chan int64
+	// incoming is only used by the receiving goroutine of the client
+	incoming map[string]*incomingFile
+}
+
+type incomingFile struct {
+	manifest *protocol.FilePart
+	name     string
+	file     *os.File
+	have     int64
+}
+
+func NewTransfers(client *chatclient.Client, out io.Writer, dir string, wantTimeout time.Duration) *Transfers {
+	return &Transfers{
+		AcceptFrom:  make(map[string]bool),
+		client:      client,
+		out:         out,
+		dir:         dir,
+		wantTimeout: wantTimeout,
+		outgoing:    make(map[string]chan int64),
+		incoming:    make(map[string]*incomingFile),
+	}
+}
+
+// Send starts sending the file at path to a nickname, or to the subscribers of a topic like "#news".
+func (transfers *Transfers) Send(target, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = errors.Errorf("%s is not a regular file", path)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		file.Close()
+		return errors.Wrap(err, "hash file error")
+	}
+	manifest := &protocol.FilePart{
+		Type: protocol.FileManifest,
+		ID:   hex.EncodeToString(hash.Sum(nil)),
+		Name: filepath.Base(path),
+		Size: info.Size(),
+	}
+
+	wants := make(chan int64, 16)
+	transfers.mu.Lock()
+	if _, ok := transfers.outgoing[manifest.ID]; ok {
+		transfers.mu.Unlock()
+		file.Close()
+		return errors.Errorf("%s is being sent already", path)
+	}
+	transfers.outgoing[manifest.ID] = wants
+	transfers.mu.Unlock()
+
+	go func() {
+		defer func() {
+			file.Close()
+			transfers.mu.Lock()
+			delete(transfers.outgoing, manifest.ID)
+			transfers.mu.Unlock()
+		}()
+		fmt.Fprintf(transfers.out, "[FILE]: sending %s (%d bytes) to %s\n", manifest.Name, manifest.Size, target)
+		if err := transfers.send(target, file, manifest, wants); err != nil {
+			fmt.Fprintln(transfers.out, errors.Wrapf(err, "send %s error, send it again to resume", manifest.Name))
+			return
+		}
+		fmt.Fprintf(transfers.out, "[FILE]: sent %s to %s\n", manifest.Name, target)
+	}()
+	return nil
+}
+
+func (transfers *Transfers) send(target string, file *os.File, manifest *protocol.FilePart, wants chan int64) error {
+	if err := transfers.sendPart(target, manifest); err != nil {
+		return err
+	}
+
+	// a nickname answers once, a topic may have any number of recipients, the answers within the timeout count
+	offset, answered := manifest.Size, false
+	timeout := time.NewTimer(transfers.wantTimeout)
+	defer timeout.Stop()
+	for waiting := true; waiting; {
+		select {
+		case want := <-wants:
+			if want < offset {
+				offset = want
+			}
+			answered = true
+			waiting = strings.HasPrefix(target, "#")
+		case <-timeout.C:
+			waiting = false
+		}
+	}
+	if !answered {
+		offset = 0
+	}
+	if offset >= manifest.Size {
+		return nil
+	}
+	if offset > 0 {
+		fmt.Fprintf(transfers.out, "[FILE]: resuming %s at %d bytes\n", manifest.Name, offset)
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	buffer := make([]byte, protocol.DefaultChunkSize)
+	for offset < manifest.Size {
+		data := buffer
+		if left := manifest.Size - offset; left < int64(len(data)) {
+			data = data[:left]
+		}
+		// the checksum was taken from what was there when sending started
+		n, err := io.ReadFull(file, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("file shrank while sending")
+		} else if err != nil {
+			return err
+		}
+		chunk := &protocol.FilePart{Type: protocol.FileChunk, ID: manifest.ID, Offset: offset, Data: data}
+		if err := transfers.sendPart(target, chunk); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+	return nil
+}
+
+func (transfers *Transfers) sendPart(target string, part *protocol.FilePart) error {
+	body, err := part.Marshal()
+	if err != nil {
+		return err
+	}
+	return transfers.client.Send("/" + protocol.CommandFile + " " + target + " " + body)
+}
+
+// Receive handles a KindFile message, it's called from the receiving goroutine of the client.
+func (transfers *Transfers) Receive(message *protocol.Message) {
+	part, err := protocol.UnmarshalFilePart(message.Body)
+	if err != nil {
+		fmt.Fprintln(transfers.out, errors.Wrap(err, "decode file part error"))
+		return
+	}
+	switch part.Type {
+	case protocol.FileWant:
+		transfers.mu.Lock()
+		wants, ok := transfers.outgoing[part.ID]
+		transfers.mu.Unlock()
+		if ok {
+			select {
+			case wants <- part.Offset:
+			default:
+			}
+		}
+	case protocol.FileManifest:
+		if message.From == nil || message.From.Nick == "" {
+			return
+		}
+		if err := transfers.accept(message.From.Nick, part); err != nil {
+			fmt.Fprintln(transfers.out, errors.Wrapf(err, "receive %s error", part.Name))
+		}
+	case protocol.FileChunk:
+		if err := transfers.write(part); err != nil {
+			fmt.Fprintln(transfers.out, errors.Wrap(err, "receive file error"))
+		}
+	}
+}
+
+// accept prepares to receive a file, and tells the sender how much of it is here already.
+func (transfers *Transfers) accept(from string, manifest *protocol.FilePart) error {
+	if !transfers.AcceptFrom[from] && !transfers.AcceptFrom["*"] {
+		return errors.Errorf("files from %s are not accepted", from)
+	}
+	if transfers.MaxSize > 0 && manifest.Size > transfers.MaxSize {
+		return errors.Errorf("%d bytes is over the limit of %d", manifest.Size, transfers.MaxSize)
+	}
+	name := filepath.Base(manifest.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return errors.Errorf("invalid file name %q", manifest.Name)
+	}
+	if previous, ok := transfers.incoming[manifest.ID]; ok {
+		previous.file.Close()
+		delete(transfers.incoming, manifest.ID)
+	}
+	if err := os.MkdirAll(transfers.dir, 0755); err != nil {
+		return err
+	}
+
+	have := int64(0)
+	if sum, err := fileSum(filepath.Join(transfers.dir, name)); err == nil && sum == manifest.ID {
+		fmt.Fprintf(transfers.out, "[FILE]: %s from %s is here already\n", name, from)
+		have = manifest.Size
+	} else {
+		file, err := os.OpenFile(transfers.partPath(manifest.ID), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err == nil && info.Size() > manifest.Size {
+			err = file.Truncate(0)
+		} else if err == nil {
+			have = info.Size()
+		}
+		if err == nil {
+			_, err = file.Seek(have, io.SeekStart)
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		incoming := &incomingFile{manifest: manifest, name: name, file: file, have: have}
+		transfers.incoming[manifest.ID] = incoming
+		if have > 0 {
+			fmt.Fprintf(transfers.out, "[FILE]: receiving %s (%d bytes) from %s, resuming at %d bytes\n", name, manifest.Size, from, have)
+		} else {
+			fmt.Fprintf(transfers.out, "[FILE]: receiving %s (%d bytes) from %s\n", name, manifest.Size, from)
+		}
+		if have == manifest.Size {
+			if err := transfers.finish(incoming); err != nil {
+				return err
+			}
+		}
+	}
+
+	want := &protocol.FilePart{Type: protocol.FileWant, ID: manifest.ID, Offset: have}
+	return transfers.sendPart(from, want)
+}
+
+func (transfers *Transfers) write(chunk *protocol.FilePart) error {
+	incoming, ok := transfers.incoming[chunk.ID]
+	if !ok {
+		// a transfer that's not for us, or done already
+		return nil
+	}
+	if chunk.Offset > incoming.have {
+		incoming.file.Close()
+		delete(transfers.incoming, chunk.ID)
+		return errors.Errorf("missed a part of %s at %d bytes, it can be sent again to resume", incoming.name, incoming.have)
+	}
+	end := chunk.Offset + int64(len(chunk.Data))
+	if end <= incoming.have {
+		return nil
+	}
+	if end > incoming.manifest.Size {
+		incoming.file.Close()
+		delete(transfers.incoming, chunk.ID)
+		return errors.Errorf("%s is larger than announced", incoming.name)
+	}
+	if _, err := incoming.file.Write(chunk.Data[incoming.have-chunk.Offset:]); err != nil {
+		incoming.file.Close()
+		delete(transfers.incoming, chunk.ID)
+		return err
+	}
+	incoming.have = end
+	if incoming.have == incoming.manifest.Size {
+		return transfers.finish(incoming)
+	}
+	return nil
+}
+
+// finish verifies a file received and moves it in place, under a new name if one is taken.
+func (transfers *Transfers) finish(incoming *incomingFile) error {
+	delete(transfers.incoming, incoming.manifest.ID)
+	partPath := transfers.partPath(incoming.manifest.ID)
+	if err := incoming.file.Close(); err != nil {
+		return err
+	}
+	sum, err := fileSum(partPath)
+	if err != nil {
+		return err
+	}
+	if sum != incoming.manifest.ID {
+		os.Remove(partPath)
+		return errors.Errorf("checksum mismatch for %s, discarded", incoming.name)
+	}
+
+	path := filepath.Join(transfers.dir, incoming.name)
+	ext := filepath.Ext(incoming.name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(transfers.dir, strings.TrimSuffix(incoming.name, ext)+"-"+strconv.Itoa(i)+ext)
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		return err
+	}
+	fmt.Fprintf(transfers.out, "[FILE]: saved %s (%d bytes, sha256 %s)\n", path, incoming.manifest.Size, sum)
+	return nil
+}
+
+func (transfers *Transfers) partPath(id string) string {
+	return filepath.Join(transfers.dir, "."+id+".part")
+}
+
+func fileSum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/chatclient"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestTransfers receives files from anybody in a new directory, the wants are queued by a client
+// that never connects.
+func newTestTransfers(t *testing.T) (*Transfers, *bytes.Buffer) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	transfers := NewTransfers(chatclient.New(chatclient.Options{QueueSize: 1000}), out, t.TempDir(), 0)
+	transfers.AcceptFrom["*"] = true
+	return transfers, out
+}
+
+func testManifest(name string, data []byte) *protocol.FilePart {
+	sum := sha256.Sum256(data)
+	return &protocol.FilePart{Type: protocol.FileManifest, ID: hex.EncodeToString(sum[:]), Name: name, Size: int64(len(data))}
+}
+
+func testChunk(manifest *protocol.FilePart, data []byte, start, end int) *protocol.FilePart {
+	return &protocol.FilePart{Type: protocol.FileChunk, ID: manifest.ID, Offset: int64(start), Data: data[start:end]}
+}
+
+// receive passes parts to transfers as the messages of a sender.
+func receive(t *testing.T, transfers *Transfers, from string, parts ...*protocol.FilePart) {
+	t.Helper()
+	for _, part := range parts {
+		body, err := part.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		transfers.Receive(&protocol.Message{Kind: protocol.KindFile, From: &protocol.Identity{Nick: from}, Body: body})
+	}
+}
+
+func expectFile(t *testing.T, path string, expected []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("expected %s to hold %q, got %q", path, expected, data)
+	}
+}
+
+func TestReceiveFile(t *testing.T) {
+	transfers, out := newTestTransfers(t)
+	data := []byte("0123456789abcdef")
+	manifest := testManifest("data.txt", data)
+	// chunks may overlap what's here already, only the rest is written
+	receive(t, transfers, "alice", manifest,
+		testChunk(manifest, data, 0, 6),
+		testChunk(manifest, data, 0, 6),
+		testChunk(manifest, data, 4, 10),
+		testChunk(manifest, data, 10, 16),
+	)
+	expectFile(t, filepath.Join(transfers.dir, "data.txt"), data)
+	if _, err := os.Stat(transfers.partPath(manifest.ID)); !os.IsNotExist(err) {
+		t.Fatalf("expected the part file to be gone, got %v", err)
+	}
+	if !strings.Contains(out.String(), "saved") {
+		t.Fatalf("expected the file to be saved, got %q", out.String())
+	}
+}
+
+func TestReceiveResume(t *testing.T) {
+	transfers, _ := newTestTransfers(t)
+	data := []byte("0123456789abcdef")
+	manifest := testManifest("data.txt", data)
+	if err := os.WriteFile(transfers.partPath(manifest.ID), data[:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, transfers, "alice", manifest)
+	if incoming := transfers.incoming[manifest.ID]; incoming == nil || incoming.have != 10 {
+		t.Fatalf("expected the transfer to resume at 10 bytes, got %+v", incoming)
+	}
+	receive(t, transfers, "alice", testChunk(manifest, data, 10, 16))
+	expectFile(t, filepath.Join(transfers.dir, "data.txt"), data)
+
+	// a file here already isn't received again
+	receive(t, transfers, "alice", manifest)
+	if _, ok := transfers.incoming[manifest.ID]; ok {
+		t.Fatal("expected a file here already not to be received again")
+	}
+}
+
+func TestReceiveOutOfOrder(t *testing.T) {
+	transfers, out := newTestTransfers(t)
+	data := []byte("0123456789abcdef")
+	manifest := testManifest("data.txt", data)
+	receive(t, transfers, "alice", manifest, testChunk(manifest, data, 0, 4), testChunk(manifest, data, 8, 12))
+	if _, ok := transfers.incoming[manifest.ID]; ok {
+		t.Fatal("expected a transfer missing a part to be dropped")
+	}
+	if !strings.Contains(out.String(), "missed a part of data.txt at 4 bytes") {
+		t.Fatalf("expected the missed part to be told, got %q", out.String())
+	}
+	// what came in order is kept to resume from
+	expectFile(t, transfers.partPath(manifest.ID), data[:4])
+	receive(t, transfers, "alice", manifest, testChunk(manifest, data, 4, 16))
+	expectFile(t, filepath.Join(transfers.dir, "data.txt"), data)
+}
+
+func TestReceiveLargerThanAnnounced(t *testing.T) {
+	transfers, out := newTestTransfers(t)
+	data := []byte("0123456789abcdef")
+	manifest := testManifest("data.txt", data[:8])
+	receive(t, transfers, "alice", manifest, testChunk(manifest, data, 0, 12))
+	if !strings.Contains(out.String(), "data.txt is larger than announced") {
+		t.Fatalf("expected the transfer to be refused, got %q", out.String())
+	}
+	if _, ok := transfers.incoming[manifest.ID]; ok {
+		t.Fatal("expected the transfer to be dropped")
+	}
+}
+
+func TestReceiveChecksumMismatch(t *testing.T) {
+	transfers, out := newTestTransfers(t)
+	data := []byte("0123456789abcdef")
+	manifest := testManifest("data.txt", data)
+	tampered := []byte("0123456789ABCDEF")
+	receive(t, transfers, "alice", manifest, testChunk(manifest, tampered, 0, 16))
+	if !strings.Contains(out.String(), "checksum mismatch for data.txt") {
+		t.Fatalf("expected the checksum mismatch to be told, got %q", out.String())
+	}
+	for _, path := range []string{filepath.Join(transfers.dir, "data.txt"), transfers.partPath(manifest.ID)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be discarded, got %v", path, err)
+		}
+	}
+}
+
+func TestReceiveNameTaken(t *testing.T) {
+	transfers, _ := newTestTransfers(t)
+	if err := os.WriteFile(filepath.Join(transfers.dir, "data.txt"), []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range [][]byte{[]byte("first"), []byte("second")} {
+		manifest := testManifest("data.txt", data)
+		receive(t, transfers, "alice", manifest, testChunk(manifest, data, 0, len(data)))
+		expectFile(t, filepath.Join(transfers.dir, "data-"+string(rune('1'+i))+".txt"), data)
+	}
+	expectFile(t, filepath.Join(transfers.dir, "data.txt"), []byte("mine"))
+}
+
+func TestReceiveRefused(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	for _, c := range []struct {
+		name     string
+		from     string
+		manifest *protocol.FilePart
+		expected string
+	}{
+		{"sender not accepted", "mallory", testManifest("data.txt", data), "files from mallory are not accepted"},
+		{"too large", "alice", testManifest("data.txt", append(data, data...)), "32 bytes is over the limit of 16"},
+		{"invalid name", "alice", testManifest("..", data), "invalid file name"},
+	} {
+		transfers, out := newTestTransfers(t)
+		transfers.AcceptFrom = map[string]bool{"alice": true}
+		transfers.MaxSize = 16
+		receive(t, transfers, c.from, c.manifest)
+		if !strings.Contains(out.String(), c.expected) {
+			t.Fatalf("%s: expected %q, got %q", c.name, c.expected, out.String())
+		}
+		if entries, err := os.ReadDir(transfers.dir); err != nil || len(entries) > 0 {
+			t.Fatalf("%s: expected nothing to be written, got %v, %v", c.name, entries, err)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/chatclient"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxLines is how many lines the message pane keeps to scroll back through.
+const maxLines = 5000
+
+const prompt = "> "
+
+// Terminal is a full screen UI, with a status bar at the top, the messages under it,
+// and a line editor at the bottom. It's redrawn as a whole on every change.
+type Terminal struct {
+	in      *os.File
+	out     *os.File
+	address string
+	restore func() error
+
+	mu     sync.Mutex
+	width  int
+	height int
+	lines  []string
+	// partial is what was written after the last newline
+	partial string
+	// scroll is how many rows the pane is scrolled back from the bottom
+	scroll   int
+	state    chatclient.State
+	stateErr error
+	input    []rune
+	cursor   int
+	history  []string
+	// recalled is the line of history being edited, len(history) for a new line, kept in draft meanwhile
+	recalled int
+	draft    []rune
+}
+
+func NewTerminal(in, out *os.File, address string) (*Terminal, error) {
+	restore, err := makeRaw(in)
+	if err != nil {
+		return nil, err
+	}
+	terminal := &Terminal{in: in, out: out, address: address, restore: restore}
+	terminal.resize()
+	// the alternate screen leaves the shell's scrollback as it was
+	out.WriteString("\x1b[?1049h\x1b[2J")
+	terminal.draw()
+	return terminal, nil
+}
+
+// Close gives the terminal back the way it was.
+func (terminal *Terminal) Close() error {
+	terminal.out.WriteString("\x1b[?1049l")
+	return terminal.restore()
+}
+
+func (terminal *Terminal) Write(p []byte) (int, error) {
+	terminal.mu.Lock()
+	defer terminal.mu.Unlock()
+	lines := strings.Split(terminal.partial+string(p), "\n")
+	terminal.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		terminal.add(sanitize(strings.TrimSuffix(line, "\r")))
+	}
+	terminal.draw()
+	return len(p), nil
+}
+
+func (terminal *Terminal) Show(message *protocol.Message) {
+	terminal.mu.Lock()
+	defer terminal.mu.Unlock()
+	for _, line := range strings.Split(render(message, colorNick), "\n") {
+		terminal.add(line)
+	}
+	terminal.draw()
+}
+
+func (terminal *Terminal) SetState(state chatclient.State, err error) {
+	terminal.mu.Lock()
+	defer terminal.mu.Unlock()
+	terminal.state = state
+	terminal.stateErr = err
+	terminal.draw()
+}
+
+func (terminal *Terminal) Run(ctx context.Context, submit func(line string)) {
+	done := make(chan struct{})
+	defer close(done)
+
+	resized := make(chan os.Signal, 1)
+	if len(resizeSignals) > 0 {
+		signal.Notify(resized, resizeSignals...)
+		defer signal.Stop(resized)
+	}
+
+	input := make(chan []byte)
+	go func() {
+		// it's left blocked reading when Run returns, the client is exiting anyway
+		for {
+			buffer := make([]byte, 256)
+			n, err := terminal.in.Read(buffer)
+			if err != nil {
+				close(input)
+				return
+			}
+			select {
+			case input <- buffer[:n]:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var pending []byte
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-resized:
+			terminal.mu.Lock()
+			terminal.resize()
+			terminal.draw()
+			terminal.mu.Unlock()
+		case data, ok := <-input:
+			if !ok {
+				return
+			}
+			pending = append(pending, data...)
+			for len(pending) > 0 {
+				key, n := parseKey(pending)
+				if n == 0 {
+					// the rest of a sequence is still on its way
+					break
+				}
+				pending = pending[n:]
+				line, quit := terminal.handle(key)
+				if quit {
+					return
+				}
+				if line != "" {
+					submit(line)
+				}
+			}
+		}
+	}
+}
+
+// add appends a line to the message pane, the pane stays put if it's scrolled back.
+func (terminal *Terminal) add(line string) {
+	terminal.lines = append(terminal.lines, line)
+	if len(terminal.lines) > maxLines {
+		terminal.lines = terminal.lines[len(terminal.lines)-maxLines:]
+	}
+	if terminal.scroll > 0 {
+		terminal.scroll += len(wrap(line, terminal.width))
+	}
+}
+
+func (terminal *Terminal) resize() {
+	width, height, err := terminalSize(terminal.out)
+	if err != nil || width <= len(prompt)+1 || height < 3 {
+		width, height = 80, 24
+	}
+	terminal.width, terminal.height = width, height
+}
+
+// handle edits the input line, it returns the line submitted with enter, if any.
+func (terminal *Terminal) handle(key key) (line string, quit bool) {
+	terminal.mu.Lock()
+	defer terminal.mu.Unlock()
+
+	switch key.name {
+	case "":
+		if key.r >= ' ' {
+			terminal.input = append(terminal.input[:terminal.cursor], append([]rune{key.r}, terminal.input[terminal.cursor:]...)...)
+			terminal.cursor++
+		}
+	case "enter":
+		line = string(terminal.input)
+		if line != "" && (len(terminal.history) == 0 || terminal.history[len(terminal.history)-1] != line) {
+			terminal.history = append(terminal.history, line)
+		}
+		terminal.recalled = len(terminal.history)
+		terminal.input, terminal.cursor, terminal.scroll = nil, 0, 0
+	case "backspace":
+		if terminal.cursor > 0 {
+			terminal.input = append(terminal.input[:terminal.cursor-1], terminal.input[terminal.cursor:]...)
+			terminal.cursor--
+		}
+	case "delete":
+		if terminal.cursor < len(terminal.input) {
+			terminal.input = append(terminal.input[:terminal.cursor], terminal.input[terminal.cursor+1:]...)
+		}
+	case "left":
+		if terminal.cursor > 0 {
+			terminal.cursor--
+		}
+	case "right":
+		if terminal.cursor < len(terminal.input) {
+			terminal.cursor++
+		}
+	case "home":
+		terminal.cursor = 0
+	case "end":
+		terminal.cursor = len(terminal.input)
+	case "up":
+		if terminal.recalled > 0 {
+			if terminal.recalled == len(terminal.history) {
+				terminal.draft = terminal.input
+			}
+			terminal.recalled--
+			terminal.input = []rune(terminal.history[terminal.recalled])
+			terminal.cursor = len(terminal.input)
+		}
+	case "down":
+		if terminal.recalled < len(terminal.history) {
+			terminal.recalled++
+			if terminal.recalled == len(terminal.history) {
+				terminal.input = terminal.draft
+			} else {
+				terminal.input = []rune(terminal.history[terminal.recalled])
+			}
+			terminal.cursor = len(terminal.input)
+		}
+	case "pgup":
+		terminal.scroll += terminal.height - 3
+	case "pgdn":
+		terminal.scroll -= terminal.height - 3
+		if terminal.scroll < 0 {
+			terminal.scroll = 0
+		}
+	case "ctrl-u":
+		terminal.input = append([]rune(nil), terminal.input[terminal.cursor:]...)
+		terminal.cursor = 0
+	case "ctrl-w":
+		start := terminal.cursor
+		for start > 0 && terminal.input[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && terminal.input[start-1] != ' ' {
+			start--
+		}
+		terminal.input = append(terminal.input[:start], terminal.input[terminal.cursor:]...)
+		terminal.cursor = start
+	case "ctrl-l":
+		terminal.out.WriteString("\x1b[2J")
+	case "ctrl-c":
+		return "", true
+	case "ctrl-d":
+		if len(terminal.input) == 0 {
+			return "", true
+		}
+	}
+	terminal.draw()
+	return line, false
+}
+
+// draw writes the whole screen at once, so it never shows half drawn.
+func (terminal *Terminal) draw() {
+	var screen strings.Builder
+	screen.WriteString("\x1b[?25l\x1b[H")
+
+	status := " " + string(terminal.state)
+	if terminal.state == "" {
+		status = " starting"
+	}
+	if terminal.stateErr != nil {
+		status += ": " + terminal.stateErr.Error()
+	}
+	status += " | " + terminal.address
+	rows := terminal.pane(terminal.height - 2)
+	if terminal.scroll > 0 {
+		status += " | scrolled back, PgDn to return"
+	}
+	status = sanitize(status)
+	screen.WriteString("\x1b[7m" + status)
+	if width := stringWidth(status); width < terminal.width {
+		screen.WriteString(strings.Repeat(" ", terminal.width-width))
+	}
+	screen.WriteString("\x1b[0m\r\n")
+
+	for i := 0; i < terminal.height-2; i++ {
+		if i < len(rows) {
+			screen.WriteString(rows[i])
+		}
+		screen.WriteString("\x1b[0m\x1b[K\r\n")
+	}
+
+	// the input line scrolls sideways to keep the cursor in sight
+	available := terminal.width - len(prompt) - 1
+	start := terminal.cursor
+	for start > 0 && runesWidth(terminal.input[start-1:terminal.cursor]) <= available {
+		start--
+	}
+	end := terminal.cursor
+	for end < len(terminal.input) && runesWidth(terminal.input[start:end+1]) <= available {
+		end++
+	}
+	screen.WriteString(prompt + string(terminal.input[start:end]) + "\x1b[K")
+	fmt.Fprintf(&screen, "\x1b[%d;%dH\x1b[?25h", terminal.height, len(prompt)+runesWidth(terminal.input[start:terminal.cursor])+1)
+
+	terminal.out.WriteString(screen.String())
+}
+
+// pane returns the rows of the message pane from the top, with the lines wrapped to the width.
+func (terminal *Terminal) pane(height int) []string {
+	var reversed []string
+	for i := len(terminal.lines) - 1; i >= 0 && len(reversed) < height+terminal.scroll; i-- {
+		wrapped := wrap(terminal.lines[i], terminal.width)
+		for j := len(wrapped) - 1; j >= 0; j-- {
+			reversed = append(reversed, wrapped[j])
+		}
+	}
+	if most := len(reversed) - height; terminal.scroll > most {
+		terminal.scroll = most
+		if terminal.scroll < 0 {
+			terminal.scroll = 0
+		}
+	}
+	end := terminal.scroll + height
+	if end > len(reversed) {
+		end = len(reversed)
+	}
+	rows := make([]string, 0, end-terminal.scroll)
+	for i := end - 1; i >= terminal.scroll; i-- {
+		rows = append(rows, reversed[i])
+	}
+	return rows
+}
+
+// wrap splits a line into rows of width columns, escape sequences take no room.
+func wrap(line string, width int) []string {
+	var rows []string
+	var row strings.Builder
+	columns := 0
+	for i := 0; i < len(line); {
+		if line[i] == '\x1b' {
+			end := escapeEnd(line, i)
+			row.WriteString(line[i:end])
+			i = end
+			continue
+		}
+		r, n := utf8.DecodeRuneInString(line[i:])
+		if columns+runeWidth(r) > width {
+			rows = append(rows, row.String())
+			row.Reset()
+			columns = 0
+		}
+		row.WriteString(line[i : i+n])
+		columns += runeWidth(r)
+		i += n
+	}
+	return append(rows, row.String())
+}
+
+// escapeEnd returns where the escape sequence starting at i ends, it's only CSI sequences, like colors.
+func escapeEnd(line string, i int) int {
+	if i+1 >= len(line) || line[i+1] != '[' {
+		return i + 1
+	}
+	for j := i + 2; j < len(line); j++ {
+		if line[j] >= 0x40 && line[j] <= 0x7e {
+			return j + 1
+		}
+	}
+	return len(line)
+}
+
+// runeWidth tells how many columns a rune takes, East Asian wide characters take two.
+func runeWidth(r rune) int {
+	switch {
+	case r >= 0x1100 && r <= 0x115f, r >= 0x2e80 && r <= 0xa4cf, r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff, r >= 0xfe30 && r <= 0xfe4f, r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6, r >= 0x1f300 && r <= 0x1f64f, r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
+
+func runesWidth(runes []rune) int {
+	width := 0
+	for _, r := range runes {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+func stringWidth(text string) int {
+	return runesWidth([]rune(text))
+}
+
+type key struct {
+	// r is the character typed, for keys without a name
+	r    rune
+	name string
+}
+
+var controlKeys = map[byte]string{
+	'\r': "enter", '\n': "enter", 0x7f: "backspace", 0x08: "backspace",
+	0x01: "home", 0x05: "end", 0x03: "ctrl-c", 0x04: "ctrl-d",
+	0x15: "ctrl-u", 0x17: "ctrl-w", 0x0c: "ctrl-l",
+}
+
+var escapeKeys = map[string]string{
+	"A": "up", "B": "down", "C": "right", "D": "left", "H": "home", "F": "end",
+	"1~": "home", "7~": "home", "4~": "end", "8~": "end", "3~": "delete", "5~": "pgup", "6~": "pgdn",
+}
+
+// parseKey reads a key from the start of input, it returns 0 bytes read if the key isn't complete yet.
+// Keys that mean nothing to the editor are read with no name and no character.
+func parseKey(input []byte) (key, int) {
+	switch {
+	case input[0] == 0x1b:
+		if len(input) < 2 {
+			return key{}, 0
+		}
+		if input[1] != '[' && input[1] != 'O' {
+			return key{}, 1
+		}
+		for i := 2; i < len(input); i++ {
+			if input[i] >= 0x40 && input[i] <= 0x7e {
+				return key{name: escapeKeys[string(input[2:i+1])]}, i + 1
+			}
+		}
+		return key{}, 0
+	case input[0] < ' ' || input[0] == 0x7f:
+		return key{name: controlKeys[input[0]]}, 1
+	case !utf8.FullRune(input):
+		return key{}, 0
+	}
+	r, n := utf8.DecodeRune(input)
+	return key{r: r}, n
+}
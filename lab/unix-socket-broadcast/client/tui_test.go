@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nickColor is the only escape sequence Show writes itself.
+var nickColor = regexp.MustCompile("\x1b\\[[0-9]+m")
+
+func TestShowSanitizes(t *testing.T) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	terminal := &Terminal{out: out, width: 80, height: 10}
+
+	evil := "\x1b[2J\x9b2J\x07\n"
+	terminal.Show(&protocol.Message{
+		Kind:  protocol.KindMessage,
+		Time:  time.Now(),
+		Topic: "news" + evil,
+		From:  &protocol.Identity{Nick: "mallory" + evil},
+		Body:  "hello" + evil + "world",
+	})
+	terminal.Show(&protocol.Message{Kind: protocol.KindDirect, Time: time.Now(), From: &protocol.Identity{Nick: "mallory"}, To: "bob" + evil, Body: "hi"})
+	terminal.Show(&protocol.Message{Kind: protocol.Kind("odd" + evil), Time: time.Now(), Body: "hi"})
+
+	if len(terminal.lines) != 4 {
+		t.Fatalf("expected only the body to span lines, got %q", terminal.lines)
+	}
+	for _, line := range terminal.lines {
+		if plain := nickColor.ReplaceAllString(line, ""); strings.ContainsAny(plain, "\x1b\x07\u009b") {
+			t.Fatalf("expected control characters to be replaced, got %q", line)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/chatclient"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+)
+
+// UI is where the client shows what happens and reads what the user types.
+type UI interface {
+	// Write shows lines of output, like errors and file transfers
+	io.Writer
+	Show(message *protocol.Message)
+	SetState(state chatclient.State, err error)
+	// Run calls submit with every line typed, until the user is done or ctx is done
+	Run(ctx context.Context, submit func(line string))
+}
+
+// plainUI prints everything on stdout and reads lines from stdin, for pipes and scripts.
+type plainUI struct{}
+
+func (plainUI) Write(p []byte) (int, error) {
+	// file names and errors may come from other users
+	if _, err := os.Stdout.WriteString(sanitize(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (plainUI) Show(message *protocol.Message) {
+	fmt.Println(render(message, plainNick))
+}
+
+func (plainUI) SetState(state chatclient.State, err error) {
+	if err != nil {
+		fmt.Printf("[%s]: %s\n", strings.ToUpper(string(state)), err)
+		return
+	}
+	fmt.Printf("[%s]\n", strings.ToUpper(string(state)))
+}
+
+func (plainUI) Run(ctx context.Context, submit func(line string)) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.Trim(line, "\n")
+		}
+	}()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			fmt.Println("[SENDING]: " + line)
+			submit(line)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func plainNick(nick string) string {
+	return nick
+}
+
+// nickColors are the ANSI foreground colors nicknames are painted with, red is left for errors.
+var nickColors = []int{32, 33, 34, 35, 36, 92, 93, 94, 95, 96}
+
+// colorNick paints a nickname in a color of its own, the same on every client.
+func colorNick(nick string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(nick)))
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", nickColors[hash.Sum32()%uint32(len(nickColors))], nick)
+}
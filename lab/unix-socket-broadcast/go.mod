@@ -1,8 +1,11 @@
-module github.com/wbsnail/articles/archive/dive-into-kubernetes-informer/basic-controller
+module github.com/wbsnail/articles/lab/unix-socket-broadcast
 
 go 1.16
 
 require (
 	github.com/pkg/errors v0.9.1
 	github.com/spongeprojects/magicconch v0.0.6
+	github.com/wbsnail/articles/lab/socketserver v0.0.0
 )
+
+replace github.com/wbsnail/articles/lab/socketserver => ../socketserver
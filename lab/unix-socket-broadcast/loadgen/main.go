@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spongeprojects/magicconch"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// bodyPrefix starts the body of every message sent, followed by the run ID, the sender, the sequence number
+// and the time it was sent, so messages of other runs and other clients are told apart.
+const bodyPrefix = "loadgen"
+
+type Config struct {
+	Network      string
+	Address      string
+	Framing      protocol.Framing
+	MaxFrameSize int
+	Topic        string
+	// Rate is how many messages every sender publishes per second
+	Rate     float64
+	Size     int
+	Duration time.Duration
+	// Drain is how long to wait for the messages still on their way after the senders stop
+	Drain time.Duration
+}
+
+// Client is one connection of the load, it publishes messages if it's a sender,
+// and checks the messages it receives.
+type Client struct {
+	id     int
+	run    string
+	config *Config
+	conn   net.Conn
+	reader *protocol.Reader
+	writer *protocol.Writer
+	stats  *Stats
+	// seen is owned by the receive goroutine, it's used to tell duplicates
+	seen map[string]bool
+}
+
+func dial(ctx context.Context, config *Config, run string, id int, stats *Stats) (*Client, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, config.Network, config.Address)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{
+		id:     id,
+		run:    run,
+		config: config,
+		conn:   conn,
+		reader: protocol.NewReader(conn, config.Framing, config.MaxFrameSize),
+		writer: protocol.NewWriter(conn, config.Framing, config.MaxFrameSize),
+		stats:  stats,
+		seen:   make(map[string]bool),
+	}
+	commands := []string{fmt.Sprintf("/nick load-%s-%d", run, id)}
+	if config.Topic != protocol.DefaultTopic {
+		commands = append(commands, "/sub "+config.Topic, "/unsub "+protocol.DefaultTopic)
+	}
+	for _, command := range commands {
+		if err := client.writer.WriteFrame([]byte(command)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func (client *Client) receive() {
+	for {
+		frame, err := client.reader.ReadFrame()
+		if err != nil {
+			return
+		}
+		message, err := protocol.UnmarshalMessage(frame)
+		if err != nil {
+			client.stats.Error(errors.Wrap(err, "decode message error"))
+			continue
+		}
+		switch message.Kind {
+		case protocol.KindPing:
+			client.writer.WriteFrame([]byte("/" + protocol.CommandPong + " " + message.Body))
+		case protocol.KindMessage:
+			if message.History {
+				continue
+			}
+			client.check(message)
+		}
+	}
+}
+
+// check records a message published by the run, others are ignored.
+func (client *Client) check(message *protocol.Message) {
+	fields := strings.SplitN(message.Body, " ", 6)
+	if len(fields) < 5 || fields[0] != bodyPrefix || fields[1] != client.run {
+		return
+	}
+	sentAt, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		client.stats.Error(errors.Wrap(err, "parse timestamp error"))
+		return
+	}
+	key := fields[2] + "/" + fields[3]
+	if client.seen[key] {
+		client.stats.Duplicate()
+		return
+	}
+	client.seen[key] = true
+	client.stats.Received(time.Since(time.Unix(0, sentAt)), len(message.Body))
+}
+
+// send publishes messages at the configured rate until ctx is done.
+func (client *Client) send(ctx context.Context) {
+	interval := time.Duration(float64(time.Second) / client.config.Rate)
+	// senders start at random offsets so they don't all publish at once
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(interval)))):
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var padding string
+	for seq := 1; ; seq++ {
+		body := fmt.Sprintf("%s %s %d %d %d", bodyPrefix, client.run, client.id, seq, time.Now().UnixNano())
+		if len(body) < client.config.Size {
+			if len(padding) != client.config.Size-len(body)-1 {
+				padding = strings.Repeat("x", client.config.Size-len(body)-1)
+			}
+			body += " " + padding
+		}
+		frame := body
+		if client.config.Topic != protocol.DefaultTopic {
+			frame = "/" + protocol.CommandPublish + " " + client.config.Topic + " " + body
+		}
+		if err := client.writer.WriteFrame([]byte(frame)); err != nil {
+			client.stats.Error(errors.Wrap(err, "send message error"))
+			return
+		}
+		client.stats.Sent()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func main() {
+	framingFlag := flag.String("framing", string(protocol.FramingLength), "message framing: length or line")
+	maxFrameSize := flag.Int("max-frame-size", protocol.DefaultMaxFrameSize, "max size of a single message in bytes")
+	network := flag.String("network", "tcp", "network to connect to: tcp or unix")
+	address := flag.String("address", "localhost:12345", "address to connect to, a file path for unix")
+	clients := flag.Int("clients", 10, "number of concurrent clients")
+	senders := flag.Int("senders", 0, "number of clients publishing messages, all of them if 0")
+	rate := flag.Float64("rate", 5, "messages per second published by every sender, mind the rate limits of the server")
+	size := flag.Int("size", 0, "pad message bodies to this many bytes")
+	topic := flag.String("topic", protocol.DefaultTopic, "topic to publish to and subscribe to")
+	duration := flag.Duration("duration", 10*time.Second, "how long to publish for")
+	drain := flag.Duration("drain", 2*time.Second, "how long to wait for messages still on their way after publishing stops")
+	connectRate := flag.Float64("connect-rate", 100, "clients connected per second, so connecting isn't mistaken for an attack")
+	flag.Parse()
+
+	framing, err := protocol.ParseFraming(*framingFlag)
+	magicconch.Must(err)
+	magicconch.Must(protocol.ValidateTopic(*topic))
+	if *clients <= 0 || *rate <= 0 || *connectRate <= 0 {
+		magicconch.Must(errors.New("-clients, -rate and -connect-rate must be positive"))
+	}
+	if *senders <= 0 || *senders > *clients {
+		*senders = *clients
+	}
+
+	config := &Config{
+		Network:      *network,
+		Address:      *address,
+		Framing:      framing,
+		MaxFrameSize: *maxFrameSize,
+		Topic:        *topic,
+		Rate:         *rate,
+		Size:         *size,
+		Duration:     *duration,
+		Drain:        *drain,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	rand.Seed(time.Now().UnixNano())
+	run := strconv.FormatInt(rand.Int63(), 36)
+	stats := NewStats()
+
+	fmt.Printf("[CONNECTING]: %d clients, run %s\n", *clients, run)
+	var receivers sync.WaitGroup
+	var connected []*Client
+	interval := time.Duration(float64(time.Second) / *connectRate)
+	for i := 0; i < *clients && ctx.Err() == nil; i++ {
+		client, err := dial(ctx, config, run, i, stats)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "connect error"))
+			break
+		}
+		connected = append(connected, client)
+		receivers.Add(1)
+		go func() {
+			defer receivers.Done()
+			client.receive()
+		}()
+		time.Sleep(interval)
+	}
+	if len(connected) == 0 {
+		os.Exit(1)
+	}
+	if *senders > len(connected) {
+		*senders = len(connected)
+	}
+
+	fmt.Printf("[SENDING]: %d senders, %g messages/s each, for %s\n", *senders, *rate, *duration)
+	sendCtx, cancel := context.WithTimeout(ctx, *duration)
+	var sending sync.WaitGroup
+	started := time.Now()
+	for _, client := range connected[:*senders] {
+		sending.Add(1)
+		go func(client *Client) {
+			defer sending.Done()
+			client.send(sendCtx)
+		}(client)
+	}
+	sending.Wait()
+	cancel()
+	elapsed := time.Since(started)
+
+	fmt.Printf("[DRAINING]: up to %s\n", *drain)
+	stats.WaitDelivered(ctx, len(connected), *drain)
+	for _, client := range connected {
+		client.conn.Close()
+	}
+	receivers.Wait()
+
+	stats.Report(os.Stdout, len(connected), elapsed)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxErrorsShown is how many errors are printed as they happen, the rest are only counted.
+const maxErrorsShown = 10
+
+// Stats collects what the clients sent and received, it's safe to be used by multiple goroutines.
+type Stats struct {
+	mu         sync.Mutex
+	sent       int
+	received   int
+	bytes      int
+	duplicates int
+	errors     int
+	latencies  []time.Duration
+}
+
+func NewStats() *Stats {
+	return &Stats{}
+}
+
+func (stats *Stats) Sent() {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.sent++
+}
+
+func (stats *Stats) Received(latency time.Duration, bytes int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.received++
+	stats.bytes += bytes
+	stats.latencies = append(stats.latencies, latency)
+}
+
+func (stats *Stats) Duplicate() {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.duplicates++
+}
+
+func (stats *Stats) Error(err error) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.errors++
+	if stats.errors <= maxErrorsShown {
+		fmt.Println(err)
+	}
+}
+
+// WaitDelivered waits until every message sent was received by all the receivers, or for at most timeout.
+func (stats *Stats) WaitDelivered(ctx context.Context, receivers int, timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		stats.mu.Lock()
+		delivered := stats.received >= stats.sent*receivers
+		stats.mu.Unlock()
+		if delivered {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Report prints the counts, the throughput over elapsed, and the latency percentiles and histogram.
+func (stats *Stats) Report(w io.Writer, receivers int, elapsed time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	expected := stats.sent * receivers
+	lost := expected - stats.received
+	seconds := elapsed.Seconds()
+	fmt.Fprintf(w, "\nclients:     %d\n", receivers)
+	fmt.Fprintf(w, "sent:        %d (%.1f/s)\n", stats.sent, float64(stats.sent)/seconds)
+	fmt.Fprintf(w, "received:    %d of %d expected (%.1f/s, %.1f KiB/s)\n",
+		stats.received, expected, float64(stats.received)/seconds, float64(stats.bytes)/1024/seconds)
+	fmt.Fprintf(w, "lost:        %d (%.2f%%)\n", lost, percent(lost, expected))
+	fmt.Fprintf(w, "duplicated:  %d\n", stats.duplicates)
+	fmt.Fprintf(w, "errors:      %d\n", stats.errors)
+	if len(stats.latencies) == 0 {
+		return
+	}
+
+	latencies := stats.latencies
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Fprintf(w, "\nlatency:\n")
+	for _, p := range []float64{50, 90, 95, 99, 99.9} {
+		fmt.Fprintf(w, "  p%-5g %s\n", p, latencies[int(float64(len(latencies)-1)*p/100)])
+	}
+	fmt.Fprintf(w, "  max    %s\n", latencies[len(latencies)-1])
+
+	fmt.Fprintf(w, "\nhistogram:\n")
+	writeHistogram(w, latencies)
+}
+
+// writeHistogram prints sorted latencies in buckets doubling in size, from the first one not empty.
+func writeHistogram(w io.Writer, latencies []time.Duration) {
+	const width = 50
+	var bounds []time.Duration
+	var counts []int
+	bound := 100 * time.Microsecond
+	for bound < latencies[0] {
+		bound *= 2
+	}
+	for i := 0; i < len(latencies); {
+		count := 0
+		for ; i < len(latencies) && latencies[i] <= bound; i++ {
+			count++
+		}
+		bounds = append(bounds, bound)
+		counts = append(counts, count)
+		bound *= 2
+	}
+
+	most := 0
+	for _, count := range counts {
+		if count > most {
+			most = count
+		}
+	}
+	for i, count := range counts {
+		bar := strings.Repeat("#", count*width/most)
+		fmt.Fprintf(w, "  <= %-10s %-*s %d (%.1f%%)\n", bounds[i], width, bar, count, percent(count, len(latencies)))
+	}
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
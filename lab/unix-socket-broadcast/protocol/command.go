@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Commands are frames starting with "/", like "/sub news.>", everything else is a plain message.
+const commandPrefix = "/"
+
+const (
+	CommandSubscribe   = "sub"
+	CommandUnsubscribe = "unsub"
+	CommandPublish     = "pub"
+	CommandNick        = "nick"
+	CommandWho         = "who"
+	CommandMessage     = "msg"
+	CommandAction      = "me"
+	CommandQuit        = "quit"
+	CommandHistory     = "history"
+	CommandPong        = "pong"
+	// CommandFile sends a part of a file transfer, like "/file bob <part>" or "/file #topic <part>".
+	CommandFile = "file"
+	// CommandLink opens a federation link, it's sent by a server to the federation port of its peer.
+	CommandLink = "link"
+)
+
+const MaxNickLength = 32
+
+type Command struct {
+	Name string
+	Args string
+}
+
+// ParseCommand returns false if text is a plain message rather than a command.
+// A message starting with "//" is a plain message with the first "/" stripped.
+func ParseCommand(text string) (*Command, bool) {
+	if !strings.HasPrefix(text, commandPrefix) || strings.HasPrefix(text, commandPrefix+commandPrefix) {
+		return nil, false
+	}
+	name, args := SplitArg(strings.TrimPrefix(text, commandPrefix))
+	return &Command{Name: name, Args: args}, true
+}
+
+// UnescapeMessage strips the "/" that escapes a plain message starting with "/".
+func UnescapeMessage(text string) string {
+	if strings.HasPrefix(text, commandPrefix+commandPrefix) {
+		return strings.TrimPrefix(text, commandPrefix)
+	}
+	return text
+}
+
+// SplitArg splits the first whitespace-separated argument from the rest.
+func SplitArg(args string) (string, string) {
+	args = strings.TrimSpace(args)
+	i := strings.IndexFunc(args, func(r rune) bool { return r == ' ' || r == '\t' })
+	if i < 0 {
+		return args, ""
+	}
+	return args[:i], strings.TrimSpace(args[i:])
+}
+
+// ValidateNick accepts 1 to MaxNickLength letters, digits, "-" and "_".
+func ValidateNick(nick string) error {
+	if nick == "" || len(nick) > MaxNickLength {
+		return fmt.Errorf("nickname must be 1 to %d characters", MaxNickLength)
+	}
+	for _, r := range nick {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid character %q in nickname", r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+)
+
+// Parts of a file transfer. The sender sends a manifest, every recipient answers with a want
+// telling how much it already has, and the sender sends the chunks from the smallest offset wanted.
+const (
+	FileManifest = "manifest"
+	FileWant     = "want"
+	FileChunk    = "chunk"
+)
+
+// DefaultChunkSize keeps a chunk, encoded as base64 in JSON, well under DefaultMaxFrameSize.
+const DefaultChunkSize = 16 * 1024
+
+// FilePart is the body of a KindFile message.
+type FilePart struct {
+	Type string `json:"type"`
+	// ID is the SHA-256 of the file, hex encoded, so a transfer interrupted is resumed by sending the same file again
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	// Data is encoded as base64, which keeps frames valid text for line framing and WebSockets
+	Data []byte `json:"data,omitempty"`
+}
+
+func (part *FilePart) Marshal() (string, error) {
+	body, err := json.Marshal(part)
+	return string(body), err
+}
+
+func UnmarshalFilePart(body string) (*FilePart, error) {
+	part := &FilePart{}
+	if err := json.Unmarshal([]byte(body), part); err != nil {
+		return nil, err
+	}
+	if id, err := hex.DecodeString(part.ID); err != nil || len(id) != 32 {
+		return nil, errors.Errorf("invalid file ID %q", part.ID)
+	}
+	if part.Size < 0 || part.Offset < 0 {
+		return nil, errors.New("negative file size or offset")
+	}
+	switch part.Type {
+	case FileManifest, FileWant, FileChunk:
+	default:
+		return nil, errors.Errorf("unknown file part %q", part.Type)
+	}
+	return part, nil
+}
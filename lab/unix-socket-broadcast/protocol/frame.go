@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"fmt"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"io"
+)
+
+// Framing decides how messages are delimited on a stream.
+type Framing string
+
+const (
+	// FramingLength prefixes every frame with its length as a 4-byte big-endian integer.
+	FramingLength Framing = "length"
+	// FramingLine terminates every frame with '\n', which is what netcat speaks.
+	FramingLine Framing = "line"
+)
+
+const DefaultMaxFrameSize = 64 * 1024
+
+// the framings are the ones of socketserver, so are their errors
+var (
+	ErrFrameTooLarge = socketserver.ErrFrameTooLarge
+	ErrInvalidFrame  = socketserver.ErrInvalidFrame
+)
+
+func ParseFraming(s string) (Framing, error) {
+	switch Framing(s) {
+	case FramingLength, FramingLine:
+		return Framing(s), nil
+	}
+	return "", fmt.Errorf("unknown framing: %q", s)
+}
+
+// Reader reads frames from a stream. After ReadFrame returns an error
+// other than io.EOF the stream is out of sync and should be closed.
+type Reader struct {
+	socketserver.FrameReader
+}
+
+func NewReader(r io.Reader, framing Framing, maxFrameSize int) *Reader {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	if framing == FramingLine {
+		return &Reader{FrameReader: socketserver.NewLineReader(r, maxFrameSize)}
+	}
+	return &Reader{FrameReader: socketserver.NewLengthReader(r, maxFrameSize)}
+}
+
+// Writer writes frames to a stream, it's safe to be used by multiple goroutines.
+type Writer struct {
+	socketserver.FrameWriter
+}
+
+func NewWriter(w io.Writer, framing Framing, maxFrameSize int) *Writer {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	if framing == FramingLine {
+		return &Writer{FrameWriter: socketserver.NewLineWriter(w, maxFrameSize)}
+	}
+	return &Writer{FrameWriter: socketserver.NewLengthWriter(w, maxFrameSize)}
+}
@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func lengthPrefixed(frame []byte) []byte {
+	buf := make([]byte, 4, len(frame)+4)
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	return append(buf, frame...)
+}
+
+func TestReaderTruncated(t *testing.T) {
+	whole := lengthPrefixed([]byte("hello"))
+	for i := 1; i < len(whole); i++ {
+		_, err := NewReader(bytes.NewReader(whole[:i]), FramingLength, 0).ReadFrame()
+		if err == nil || err == io.EOF {
+			t.Fatalf("%d of %d bytes: expected an unexpected EOF, got %v", i, len(whole), err)
+		}
+	}
+	if _, err := NewReader(bytes.NewReader(nil), FramingLength, 0).ReadFrame(); err != io.EOF {
+		t.Fatalf("empty stream: expected io.EOF, got %v", err)
+	}
+}
+
+func TestReaderTooLarge(t *testing.T) {
+	header := []byte{0xff, 0xff, 0xff, 0xff}
+	_, err := NewReader(bytes.NewReader(header), FramingLength, 16).ReadFrame()
+	if !isFrameTooLarge(err) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+	_, err = NewReader(bytes.NewReader(bytes.Repeat([]byte("a"), 17)), FramingLine, 16).ReadFrame()
+	if !isFrameTooLarge(err) {
+		t.Fatalf("expected ErrFrameTooLarge for a line, got %v", err)
+	}
+}
+
+func TestWriterReaderRoundTrip(t *testing.T) {
+	for _, framing := range []Framing{FramingLength, FramingLine} {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf, framing, 0)
+		frames := []string{"hello", "", "/sub news.>", "héllo wörld"}
+		for _, frame := range frames {
+			if err := writer.WriteFrame([]byte(frame)); err != nil {
+				t.Fatalf("%s: write %q: %v", framing, frame, err)
+			}
+		}
+		reader := NewReader(&buf, framing, 0)
+		for _, frame := range frames {
+			got, err := reader.ReadFrame()
+			if err != nil {
+				t.Fatalf("%s: read %q: %v", framing, frame, err)
+			}
+			if string(got) != frame {
+				t.Fatalf("%s: expected %q, got %q", framing, frame, got)
+			}
+		}
+		if _, err := reader.ReadFrame(); err != io.EOF {
+			t.Fatalf("%s: expected io.EOF after the last frame, got %v", framing, err)
+		}
+	}
+}
+
+func TestUnmarshalMessageInvalid(t *testing.T) {
+	for _, frame := range []string{"", "{", "not json", `{"kind": 1}`, `{"time": "yesterday"}`} {
+		if _, err := UnmarshalMessage([]byte(frame)); err == nil {
+			t.Fatalf("%q: expected an error", frame)
+		}
+	}
+}
+
+// FuzzReader feeds arbitrary streams to both framings, a reader must never panic
+// or return a frame over the max frame size, whatever the length prefixes say.
+func FuzzReader(f *testing.F) {
+	f.Add(lengthPrefixed([]byte("hello")))
+	f.Add(lengthPrefixed([]byte(`{"kind":"message","body":"hi"}`))[:10])
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 'a'})
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte("hello\r\nworld"))
+	f.Add(bytes.Repeat([]byte("a\n"), 100))
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		const maxFrameSize = 64
+		for _, framing := range []Framing{FramingLength, FramingLine} {
+			reader := NewReader(bytes.NewReader(stream), framing, maxFrameSize)
+			for {
+				frame, err := reader.ReadFrame()
+				if err != nil {
+					break
+				}
+				if len(frame) > maxFrameSize {
+					t.Fatalf("%s: frame of %d bytes over the max of %d", framing, len(frame), maxFrameSize)
+				}
+			}
+		}
+	})
+}
+
+// FuzzUnmarshalMessage checks that decoding never panics, and that a decoded message survives a round trip.
+func FuzzUnmarshalMessage(f *testing.F) {
+	f.Add([]byte(`{"kind":"message","seq":1,"time":"2021-05-01T00:00:00Z","topic":"general","from":{"nick":"bob"},"body":"hi"}`))
+	f.Add([]byte(`{"kind":"notice","body":"welcome"`))
+	f.Add([]byte(`{"kind":"file","body":"{\"type\":\"manifest\"}"}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte{0xff, 0xfe})
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		message, err := UnmarshalMessage(frame)
+		if err != nil {
+			return
+		}
+		encoded, err := message.Marshal()
+		if err != nil {
+			// times outside the years 0 to 9999 can be decoded but not encoded
+			return
+		}
+		if _, err := UnmarshalMessage(encoded); err != nil {
+			t.Fatalf("re-decoding %q: %v", encoded, err)
+		}
+	})
+}
+
+func isFrameTooLarge(err error) bool {
+	for err != nil {
+		if err == ErrFrameTooLarge {
+			return true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+	return false
+}
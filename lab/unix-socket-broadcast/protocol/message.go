@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Credentials of the process on the other end of a Unix socket, as reported by SO_PEERCRED.
+type Credentials struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	PID int32  `json:"pid"`
+}
+
+func (cred Credentials) String() string {
+	return fmt.Sprintf("uid=%d,gid=%d,pid=%d", cred.UID, cred.GID, cred.PID)
+}
+
+// Identity tells who sent a message.
+type Identity struct {
+	Nick string `json:"nick,omitempty"`
+	Addr string `json:"addr,omitempty"`
+	// CommonName is the subject of the certificate the client authenticated with over mutual TLS.
+	CommonName string       `json:"cn,omitempty"`
+	Cred       *Credentials `json:"cred,omitempty"`
+	// Server is the federation ID of the server the sender is connected to, it's only set on messages
+	// relayed from another server, nothing but the nickname can be verified there.
+	Server string `json:"server,omitempty"`
+	// Via is the linked server a relayed message came through when it's not the one of the sender,
+	// it's the only server that authenticated itself to the receiving one.
+	Via string `json:"via,omitempty"`
+}
+
+func (identity Identity) String() string {
+	if identity.Server != "" {
+		nick := identity.Nick
+		if nick == "" {
+			nick = "unknown"
+		}
+		if identity.Via != "" {
+			return nick + "@" + identity.Server + " via " + identity.Via
+		}
+		return nick + "@" + identity.Server
+	}
+	if identity.Nick != "" {
+		return identity.Nick
+	}
+	if identity.CommonName != "" {
+		return "cn=" + identity.CommonName
+	}
+	if identity.Cred != nil {
+		return identity.Cred.String()
+	}
+	if identity.Addr != "" {
+		return identity.Addr
+	}
+	return "unknown"
+}
+
+type Kind string
+
+const (
+	// KindMessage is a message published by a client to a topic.
+	KindMessage Kind = "message"
+	// KindAction is a "/me" message, like "* bob waves".
+	KindAction Kind = "action"
+	// KindDirect is a message sent to a single nickname by "/msg".
+	KindDirect Kind = "direct"
+	// KindNotice is the server replying to a command of the receiving client.
+	KindNotice Kind = "notice"
+	// KindJoin, KindLeave and KindNick are presence events, From is the client concerned.
+	KindJoin  Kind = "join"
+	KindLeave Kind = "leave"
+	// KindNick has the old nickname in Body.
+	KindNick Kind = "nick"
+	// KindFile is a part of a file transfer, Body is a FilePart encoded as JSON. It's sent to To, or to the
+	// subscribers of Topic but the sender, and it's neither numbered nor kept in the history.
+	KindFile Kind = "file"
+	// KindPing is a heartbeat from the server, clients answer it with "/pong <body>".
+	KindPing Kind = "ping"
+)
+
+// Message is what the server sends to clients, one per frame, encoded as JSON.
+type Message struct {
+	Kind Kind `json:"kind"`
+	// Seq numbers messages published to topics, it's increasing across all topics
+	Seq   uint64    `json:"seq,omitempty"`
+	Time  time.Time `json:"time"`
+	Topic string    `json:"topic,omitempty"`
+	From  *Identity `json:"from,omitempty"`
+	To    string    `json:"to,omitempty"`
+	Body  string    `json:"body"`
+	// History is set on messages replayed from the server's history
+	History bool `json:"history,omitempty"`
+	// Origin is the ID of the server the message was published on, when servers are federated,
+	// OriginSeq its sequence number there and Hops the number of links it went through.
+	Origin    string `json:"origin,omitempty"`
+	OriginSeq uint64 `json:"origin_seq,omitempty"`
+	Hops      int    `json:"hops,omitempty"`
+	// LastSeq is set on the welcome notice, it's the Seq of the last message published on the server,
+	// a client that saw later ones is talking to a server that started over without its message log.
+	LastSeq uint64 `json:"last_seq,omitempty"`
+}
+
+func (message *Message) Marshal() ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func UnmarshalMessage(frame []byte) (*Message, error) {
+	message := &Message{}
+	if err := json.Unmarshal(frame, message); err != nil {
+		return nil, errors.Wrap(err, "decode message error")
+	}
+	return message, nil
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// DefaultTopic is where plain messages go, and what every client is subscribed to when it joins.
+const DefaultTopic = "general"
+
+// Topics are dot-separated tokens like "news.sports". In subscription patterns
+// "*" matches exactly one token, and ">" as the last token matches one or more tokens,
+// so "news.*" matches "news.sports" but not "news.sports.football", "news.>" matches both.
+const (
+	topicSeparator   = "."
+	singleWildcard   = "*"
+	multipleWildcard = ">"
+)
+
+func ValidateTopic(topic string) error {
+	return validateTokens(topic, false)
+}
+
+func ValidatePattern(pattern string) error {
+	return validateTokens(pattern, true)
+}
+
+func validateTokens(s string, wildcards bool) error {
+	if s == "" {
+		return fmt.Errorf("empty topic")
+	}
+	tokens := strings.Split(s, topicSeparator)
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return fmt.Errorf("empty token in topic %q", s)
+		case token == singleWildcard, token == multipleWildcard:
+			if !wildcards {
+				return fmt.Errorf("wildcard not allowed in topic %q", s)
+			}
+			if token == multipleWildcard && i != len(tokens)-1 {
+				return fmt.Errorf("%q must be the last token in pattern %q", multipleWildcard, s)
+			}
+		case strings.ContainsAny(token, singleWildcard+multipleWildcard):
+			return fmt.Errorf("wildcard must be a whole token in %q", s)
+		case strings.IndexFunc(token, unicode.IsSpace) >= 0:
+			return fmt.Errorf("whitespace in topic %q", s)
+		}
+	}
+	return nil
+}
+
+// IsWildcard tells if a pattern matches more than one topic.
+func IsWildcard(pattern string) bool {
+	for _, token := range strings.Split(pattern, topicSeparator) {
+		if token == singleWildcard || token == multipleWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTopic tells if a topic matches a subscription pattern, both should be valid.
+// Wildcards don't match empty tokens, and ">" is only a wildcard as the last token.
+func MatchTopic(pattern, topic string) bool {
+	patternTokens := strings.Split(pattern, topicSeparator)
+	topicTokens := strings.Split(topic, topicSeparator)
+	for i, token := range patternTokens {
+		if token == multipleWildcard && i == len(patternTokens)-1 {
+			if len(topicTokens) <= i {
+				return false
+			}
+			for _, rest := range topicTokens[i:] {
+				if rest == "" {
+					return false
+				}
+			}
+			return true
+		}
+		if i >= len(topicTokens) {
+			return false
+		}
+		if token == singleWildcard && topicTokens[i] == "" || token != singleWildcard && token != topicTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(topicTokens)
+}
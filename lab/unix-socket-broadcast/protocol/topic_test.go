@@ -0,0 +1,55 @@
+package protocol
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		topic   string
+		matches bool
+	}{
+		{"news", "news", true},
+		{"news", "news.sports", false},
+		{"news.sports", "news", false},
+		{"news.*", "news.sports", true},
+		{"news.*", "news", false},
+		{"news.*", "news.sports.football", false},
+		{"*.sports", "news.sports", true},
+		{"news.*.football", "news.sports.football", true},
+		{"news.>", "news.sports", true},
+		{"news.>", "news.sports.football", true},
+		{"news.>", "news", false},
+		{">", "news", true},
+		{">", "news.sports.football", true},
+		// ">" is only a wildcard as the last token
+		{"news.>.football", "news.sports.football", false},
+		{"news.>.football", "news.sports.tennis", false},
+		// wildcards don't match empty tokens
+		{"news.*", "news.", false},
+		{"news.*.football", "news..football", false},
+		{"news.>", "news.", false},
+		{"news.>", "news.sports.", false},
+		{">", "", false},
+		{"*", "", false},
+	} {
+		if matches := MatchTopic(c.pattern, c.topic); matches != c.matches {
+			t.Fatalf("MatchTopic(%q, %q): expected %v, got %v", c.pattern, c.topic, c.matches, matches)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	for _, pattern := range []string{"news", "news.*", "news.>", ">", "*.sports.>"} {
+		if err := ValidatePattern(pattern); err != nil {
+			t.Fatalf("expected %q to be valid, got %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"", "news.", ".news", "news..sports", "news.>.sports", "news.sp*", "news sports"} {
+		if ValidatePattern(pattern) == nil {
+			t.Fatalf("expected %q to be refused", pattern)
+		}
+	}
+	if ValidateTopic("news.*") == nil || ValidateTopic("news.>") == nil {
+		t.Fatal("expected wildcards to be refused in topics")
+	}
+}
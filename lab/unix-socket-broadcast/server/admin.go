@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Kick asks the manager to disconnect the client with a nickname.
+type Kick struct {
+	nick   string
+	reason string
+	// kicked receives whether there was such a client
+	kicked chan bool
+}
+
+// Clients lists the connected clients, federation links included, it returns nil once the manager is done.
+func (manager *ClientManager) Clients() []ClientInfo {
+	result := make(chan []ClientInfo, 1)
+	select {
+	case manager.clientsCh <- result:
+		return <-result
+	case <-manager.done:
+		return nil
+	}
+}
+
+// Kick disconnects the client with a nickname, it returns false if there is none.
+func (manager *ClientManager) Kick(nick, reason string) bool {
+	kick := &Kick{nick: nick, reason: reason, kicked: make(chan bool, 1)}
+	select {
+	case manager.kickCh <- kick:
+		return <-kick.kicked
+	case <-manager.done:
+		return false
+	}
+}
+
+func (manager *ClientManager) kick(kick *Kick) bool {
+	client, ok := manager.nicks[strings.ToLower(kick.nick)]
+	if !ok {
+		return false
+	}
+	reason := "kicked"
+	if kick.reason != "" {
+		reason += ": " + kick.reason
+	}
+	fmt.Println("[KICKED]: Client kicked: " + describe(client.identity))
+	manager.deliver(client, notice("you were "+reason))
+	client.quitReason = reason
+	atomic.AddUint64(&manager.metrics.kicked, 1)
+	// the send goroutine writes what's queued, the notice included, and closes the socket
+	manager.remove(client)
+	return true
+}
+
+// KickRequest is the JSON body of "/kick". Browsers can't send it to another site without asking
+// first, the admin endpoint never agrees, so a page can't kick clients through an admin's browser.
+type KickRequest struct {
+	Nick   string `json:"nick"`
+	Reason string `json:"reason,omitempty"`
+}
+
+const kickUsage = `usage: POST /kick with a JSON body like {"nick": "bob", "reason": "spam"}`
+
+// admin serves the metrics on "/metrics", the clients on "/clients" and kicks them on "/kick".
+func (server *Server) admin() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		clients := server.manager.Clients()
+		if clients == nil {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		var body bytes.Buffer
+		server.manager.writeMetrics(&body, clients)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(body.Bytes())
+	})
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		clients := server.manager.Clients()
+		if clients == nil {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		data, err := json.MarshalIndent(clients, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(data, '\n'))
+	})
+	mux.HandleFunc("/kick", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if server.AdminToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(server.AdminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "invalid admin token", http.StatusUnauthorized)
+				return
+			}
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, kickUsage, http.StatusUnsupportedMediaType)
+			return
+		}
+		var request KickRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil || request.Nick == "" {
+			http.Error(w, kickUsage, http.StatusBadRequest)
+			return
+		}
+		nick := request.Nick
+		if !server.manager.Kick(nick, request.Reason) {
+			http.Error(w, "no such nickname: "+nick, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, "kicked "+nick)
+	})
+	return mux
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminKick(t *testing.T) {
+	server := startServer(t, ManagerConfig{}, func(server *Server) { server.AdminToken = "secret" })
+	bob := dialServer(t, server)
+	bob.send(t, "/nick bob")
+	bob.expect(t, protocol.KindNick, "")
+	admin := server.admin()
+
+	kick := `{"nick": "bob", "reason": "spam"}`
+	for _, c := range []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		token       string
+		body        string
+		code        int
+	}{
+		{"not a post", http.MethodGet, "/kick", "application/json", "secret", kick, http.StatusMethodNotAllowed},
+		{"no token", http.MethodPost, "/kick", "application/json", "", kick, http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "/kick", "application/json", "guess", kick, http.StatusUnauthorized},
+		// what a form on another site can send
+		{"query", http.MethodPost, "/kick?nick=bob", "", "secret", "", http.StatusUnsupportedMediaType},
+		{"form", http.MethodPost, "/kick", "application/x-www-form-urlencoded", "secret", "nick=bob", http.StatusUnsupportedMediaType},
+		{"plain text", http.MethodPost, "/kick", "text/plain", "secret", kick, http.StatusUnsupportedMediaType},
+		{"no nickname", http.MethodPost, "/kick", "application/json", "secret", `{"reason": "spam"}`, http.StatusBadRequest},
+		{"not json", http.MethodPost, "/kick", "application/json", "secret", "bob", http.StatusBadRequest},
+		{"no such nickname", http.MethodPost, "/kick", "application/json", "secret", `{"nick": "carol"}`, http.StatusNotFound},
+	} {
+		request := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		if c.contentType != "" {
+			request.Header.Set("Content-Type", c.contentType)
+		}
+		if c.token != "" {
+			request.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, request)
+		if recorder.Code != c.code {
+			t.Fatalf("%s: expected %d, got %d: %s", c.name, c.code, recorder.Code, recorder.Body.String())
+		}
+	}
+	if len(server.manager.Clients()) != 1 {
+		t.Fatal("expected bob to be connected still")
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/kick", strings.NewReader(kick))
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected bob to be kicked, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	bob.expect(t, protocol.KindNotice, "you were kicked: spam")
+	bob.expectClosed(t, 2*time.Second)
+}
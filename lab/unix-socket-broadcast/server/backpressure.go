@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what to do with a message for a client whose queue is full.
+type OverflowPolicy string
+
+const (
+	// PolicyDropOldest discards the oldest queued message to make room for the new one.
+	PolicyDropOldest OverflowPolicy = "drop-oldest"
+	// PolicyDropNewest discards the new message.
+	PolicyDropNewest OverflowPolicy = "drop-newest"
+	// PolicyBlock waits up to ManagerConfig.BlockTimeout for room, then discards the new message,
+	// the whole manager waits with it, so keep the timeout short.
+	PolicyBlock OverflowPolicy = "block"
+	// PolicyDisconnect disconnects the client.
+	PolicyDisconnect OverflowPolicy = "disconnect"
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch OverflowPolicy(s) {
+	case PolicyDropOldest, PolicyDropNewest, PolicyBlock, PolicyDisconnect:
+		return OverflowPolicy(s), nil
+	}
+	return "", fmt.Errorf("unknown overflow policy: %q", s)
+}
+
+// deliverFrame queues a frame for a client, applying the overflow policy if its queue is full.
+func (manager *ClientManager) deliverFrame(client *Client, frame []byte) {
+	if _, ok := manager.clients[client]; !ok {
+		return
+	}
+	select {
+	case client.data <- frame:
+		return
+	default:
+	}
+
+	switch manager.config.OverflowPolicy {
+	case PolicyDropOldest:
+		// the send goroutine may take the oldest one first, either way there's room after this
+		select {
+		case <-client.data:
+			manager.drop(client)
+		default:
+		}
+		select {
+		case client.data <- frame:
+		default:
+			manager.drop(client)
+		}
+	case PolicyDropNewest:
+		manager.drop(client)
+	case PolicyBlock:
+		timer := time.NewTimer(manager.config.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case client.data <- frame:
+		case <-timer.C:
+			manager.drop(client)
+		}
+	default:
+		fmt.Println("[SLOW]: Client too slow, disconnecting: " + describe(client.identity))
+		manager.remove(client)
+	}
+}
+
+func (manager *ClientManager) drop(client *Client) {
+	atomic.AddUint64(&manager.metrics.dropped, 1)
+	if atomic.AddUint64(&client.dropped, 1) == 1 {
+		fmt.Println("[SLOW]: Client too slow, dropping messages: " + describe(client.identity))
+	}
+}
+
+func (client *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&client.dropped)
+}
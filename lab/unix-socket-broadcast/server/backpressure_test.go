@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T, config ManagerConfig) *ClientManager {
+	t.Helper()
+	if config.Framing == "" {
+		config.Framing = protocol.FramingLine
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 64
+	}
+	manager := NewClientManager(config)
+	go manager.start()
+	t.Cleanup(func() { manager.Shutdown(time.Now()) })
+	return manager
+}
+
+// connectPipe registers a client on one end of a pipe and returns the other end,
+// nothing is written to the client until the other end is read.
+func connectPipe(t *testing.T, manager *ClientManager, name string) (*Client, net.Conn) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	client := manager.newClient(conn, protocol.Identity{Addr: name})
+	if !manager.register(client) {
+		t.Fatal("manager shut down")
+	}
+	go manager.send(client)
+	return client, peer
+}
+
+// clientInfos asks the manager for its clients, it also waits for what was sent to the manager before.
+func clientInfos(manager *ClientManager) []ClientInfo {
+	result := make(chan []ClientInfo)
+	manager.clientsCh <- result
+	return <-result
+}
+
+// readBodies reads the messages written to a pipe until nothing comes for a while or it's closed.
+func readBodies(t *testing.T, peer net.Conn) (bodies []string, closed bool) {
+	t.Helper()
+	reader := protocol.NewReader(peer, protocol.FramingLine, 0)
+	for {
+		peer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			return bodies, true
+		}
+		if err != nil {
+			return bodies, false
+		}
+		message, err := protocol.UnmarshalMessage(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Kind == protocol.KindMessage {
+			bodies = append(bodies, message.Body)
+		}
+	}
+}
+
+// flood publishes n messages from sender, to a slow client that never reads.
+func flood(t *testing.T, policy OverflowPolicy, n int) (*ClientManager, *Client, net.Conn) {
+	t.Helper()
+	manager := newTestManager(t, ManagerConfig{QueueSize: 4, OverflowPolicy: policy, BlockTimeout: 10 * time.Millisecond})
+	slow, slowPeer := connectPipe(t, manager, "slow")
+	sender, senderPeer := connectPipe(t, manager, "sender")
+	go io.Copy(io.Discard, senderPeer)
+
+	for i := 0; i < n; i++ {
+		manager.publish(sender, &protocol.Message{Kind: protocol.KindMessage, Topic: protocol.DefaultTopic, Body: fmt.Sprint(i)})
+	}
+	clientInfos(manager)
+	return manager, slow, slowPeer
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	_, slow, peer := flood(t, PolicyDropOldest, 20)
+	if slow.Dropped() == 0 {
+		t.Fatal("expected dropped messages")
+	}
+	bodies, _ := readBodies(t, peer)
+	if len(bodies) == 0 || bodies[len(bodies)-1] != "19" {
+		t.Fatalf("expected the newest messages to be kept, got %v", bodies)
+	}
+	if bodies[0] == "0" {
+		t.Fatalf("expected the oldest messages to be dropped, got %v", bodies)
+	}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	_, slow, peer := flood(t, PolicyDropNewest, 20)
+	if slow.Dropped() == 0 {
+		t.Fatal("expected dropped messages")
+	}
+	bodies, _ := readBodies(t, peer)
+	if len(bodies) == 0 || bodies[0] != "0" {
+		t.Fatalf("expected the oldest messages to be kept, got %v", bodies)
+	}
+	if bodies[len(bodies)-1] == "19" {
+		t.Fatalf("expected the newest messages to be dropped, got %v", bodies)
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	start := time.Now()
+	_, slow, peer := flood(t, PolicyBlock, 10)
+	if slow.Dropped() == 0 {
+		t.Fatal("expected dropped messages after the block timeout")
+	}
+	// every dropped message waited for the block timeout
+	if elapsed, min := time.Since(start), time.Duration(slow.Dropped())*10*time.Millisecond; elapsed < min {
+		t.Fatalf("expected publishing to wait at least %s, it took %s", min, elapsed)
+	}
+	if bodies, _ := readBodies(t, peer); len(bodies) == 0 || bodies[0] != "0" {
+		t.Fatalf("expected the messages queued before blocking, got %v", bodies)
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	manager, slow, peer := flood(t, PolicyDisconnect, 20)
+	for _, info := range clientInfos(manager) {
+		if info.Addr == slow.identity.Addr {
+			t.Fatal("expected the slow client to be disconnected")
+		}
+	}
+	// what was queued is still written before the connection is closed
+	if _, closed := readBodies(t, peer); !closed {
+		t.Fatal("expected the connection of the slow client to be closed")
+	}
+	if slow.Dropped() != 0 {
+		t.Fatalf("expected no dropped messages, got %d", slow.Dropped())
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"sort"
+	"strings"
+)
+
+// join gives a new client its certificate name as nickname, or a free guest nickname
+// if it has none or it's taken, and tells everybody about it.
+func (manager *ClientManager) join(client *Client) {
+	if name := client.identity.CommonName; protocol.ValidateNick(name) == nil {
+		if _, taken := manager.nicks[strings.ToLower(name)]; !taken {
+			client.identity.Nick = name
+		}
+	}
+	for client.identity.Nick == "" {
+		manager.guestCounter++
+		nick := fmt.Sprintf("guest%d", manager.guestCounter)
+		if _, taken := manager.nicks[strings.ToLower(nick)]; !taken {
+			client.identity.Nick = nick
+		}
+	}
+	manager.nicks[strings.ToLower(client.identity.Nick)] = client
+
+	greeting := "welcome, you are " + client.identity.Nick
+	if client.identity.CommonName == "" {
+		greeting += ", change it with /nick <name>"
+	}
+	welcome := notice(greeting)
+	welcome.LastSeq = manager.seq
+	manager.deliver(client, welcome)
+	manager.announce(protocol.KindJoin, client, "", client)
+}
+
+func (manager *ClientManager) leave(client *Client) {
+	delete(manager.nicks, strings.ToLower(client.identity.Nick))
+	manager.announce(protocol.KindLeave, client, client.quitReason, client)
+}
+
+func (manager *ClientManager) changeNick(client *Client, nick string) {
+	old := client.identity.Nick
+	if other, taken := manager.nicks[strings.ToLower(nick)]; taken && other != client {
+		manager.deliver(client, notice("nickname "+nick+" is already taken"))
+		return
+	}
+	delete(manager.nicks, strings.ToLower(old))
+	client.identity.Nick = nick
+	manager.nicks[strings.ToLower(nick)] = client
+	fmt.Println("[NICK]: " + old + " is now known as " + nick)
+	manager.announce(protocol.KindNick, client, old, nil)
+}
+
+// announce sends a presence event about a client to every client except one, which can be nil.
+func (manager *ClientManager) announce(kind protocol.Kind, subject *Client, body string, except *Client) {
+	identity := subject.identity
+	message := &protocol.Message{Kind: kind, From: &identity, Body: body}
+	for client := range manager.clients {
+		if client != except && client.link == "" {
+			manager.deliver(client, message)
+		}
+	}
+}
+
+func (manager *ClientManager) who() string {
+	var lines []string
+	for client := range manager.clients {
+		if client.link != "" {
+			continue
+		}
+		line := describe(client.identity)
+		if dropped := client.Dropped(); dropped > 0 {
+			line += fmt.Sprintf(" [%d dropped]", dropped)
+		}
+		if limited := client.Limited(); limited > 0 {
+			line += fmt.Sprintf(" [%d limited]", limited)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return fmt.Sprintf("%d online:\n%s", len(lines), strings.Join(lines, "\n"))
+}
+
+// direct delivers a "/msg" to its recipient, and echoes it back to the sender.
+func (manager *ClientManager) direct(sender *Client, message *protocol.Message) {
+	recipient, ok := manager.nicks[strings.ToLower(message.To)]
+	if !ok {
+		manager.deliver(sender, notice("no such nickname: "+message.To))
+		return
+	}
+	message.To = recipient.identity.Nick
+	manager.deliver(recipient, message)
+	if recipient != sender {
+		manager.deliver(sender, message)
+	}
+}
+
+// transfer delivers a part of a file transfer to its recipient, or to the subscribers of its topic but the sender.
+// It's not logged, chunks would flood the history, clients resume interrupted transfers themselves.
+func (manager *ClientManager) transfer(sender *Client, message *protocol.Message) {
+	if message.Topic == "" {
+		recipient, ok := manager.nicks[strings.ToLower(message.To)]
+		if !ok {
+			manager.deliver(sender, notice("no such nickname: "+message.To))
+			return
+		}
+		message.To = recipient.identity.Nick
+		manager.deliver(recipient, message)
+		return
+	}
+	frame, err := message.Marshal()
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "encode message error"))
+		return
+	}
+	for client := range manager.subscribers(message.Topic) {
+		if client != sender {
+			manager.deliverFrame(client, frame)
+		}
+	}
+}
+
+// describe prints everything known about an identity, like "bob (uid=1000,gid=1000,pid=42)".
+func describe(identity protocol.Identity) string {
+	var details []string
+	if identity.CommonName != "" {
+		details = append(details, "cn="+identity.CommonName)
+	}
+	if identity.Cred != nil {
+		details = append(details, identity.Cred.String())
+	}
+	if identity.Addr != "" {
+		details = append(details, identity.Addr)
+	}
+	if len(details) == 0 {
+		return identity.String()
+	}
+	return identity.String() + " (" + strings.Join(details, ", ") + ")"
+}
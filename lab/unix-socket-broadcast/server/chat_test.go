@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectIdentity registers a client with identity on one end of a pipe, reading what the other end writes.
+func connectIdentity(t *testing.T, manager *ClientManager, identity protocol.Identity) (*protocol.Reader, *protocol.Writer) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	client := manager.newClient(conn, identity)
+	if !manager.register(client) {
+		t.Fatal("manager shut down")
+	}
+	go manager.send(client)
+	go manager.receive(client)
+	peer.SetDeadline(time.Now().Add(2 * time.Second))
+	return protocol.NewReader(peer, protocol.FramingLine, 0), protocol.NewWriter(peer, protocol.FramingLine, 0)
+}
+
+// expectNotice reads until a notice starting with prefix comes.
+func expectNotice(t *testing.T, reader *protocol.Reader, prefix string) {
+	t.Helper()
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatalf("waiting for notice %q: %v", prefix, err)
+		}
+		message, err := protocol.UnmarshalMessage(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Kind == protocol.KindNotice && strings.HasPrefix(message.Body, prefix) {
+			return
+		}
+	}
+}
+
+func TestNickFromCertificate(t *testing.T) {
+	manager := newTestManager(t, ManagerConfig{})
+	alice, aliceWriter := connectIdentity(t, manager, protocol.Identity{Addr: "alice", CommonName: "alice"})
+	expectNotice(t, alice, "welcome, you are alice")
+	guest, guestWriter := connectIdentity(t, manager, protocol.Identity{Addr: "guest"})
+	expectNotice(t, guest, "welcome, you are guest1, change it with /nick")
+
+	if err := aliceWriter.WriteFrame([]byte("/nick bob")); err != nil {
+		t.Fatal(err)
+	}
+	expectNotice(t, alice, "your nickname comes from your certificate")
+	if err := guestWriter.WriteFrame([]byte("/nick alice")); err != nil {
+		t.Fatal(err)
+	}
+	expectNotice(t, guest, "nickname alice is already taken")
+
+	for _, info := range clientInfos(manager) {
+		if info.CommonName == "alice" && info.Nick != "alice" {
+			t.Fatalf("expected the certificate name as nickname, got %q", info.Nick)
+		}
+	}
+}
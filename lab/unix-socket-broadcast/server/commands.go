@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"strconv"
+	"strings"
+)
+
+// handleCommand runs in the receive goroutine of the client,
+// anything touching the manager's state goes through its channels.
+// It returns true if the client asked to quit.
+func (manager *ClientManager) handleCommand(client *Client, command *protocol.Command) bool {
+	switch command.Name {
+	case protocol.CommandSubscribe:
+		pattern, _ := protocol.SplitArg(command.Args)
+		if err := protocol.ValidatePattern(pattern); err != nil {
+			manager.reply(client, notice("usage: /sub <pattern>: "+err.Error()))
+			return false
+		}
+		select {
+		case manager.subscribeCh <- &Subscription{client: client, pattern: pattern}:
+		case <-manager.done:
+		}
+	case protocol.CommandUnsubscribe:
+		pattern, _ := protocol.SplitArg(command.Args)
+		if err := protocol.ValidatePattern(pattern); err != nil {
+			manager.reply(client, notice("usage: /unsub <pattern>: "+err.Error()))
+			return false
+		}
+		select {
+		case manager.unsubscribeCh <- &Subscription{client: client, pattern: pattern}:
+		case <-manager.done:
+		}
+	case protocol.CommandPublish:
+		topic, body := protocol.SplitArg(command.Args)
+		if err := protocol.ValidateTopic(topic); err != nil {
+			manager.reply(client, notice("usage: /pub <topic> <message>: "+err.Error()))
+			return false
+		}
+		manager.publish(client, &protocol.Message{Kind: protocol.KindMessage, Topic: topic, Body: body})
+	case protocol.CommandNick:
+		// the nickname of a client with a certificate is its certificate name, nobody can take it over
+		if client.identity.CommonName != "" {
+			manager.reply(client, notice("your nickname comes from your certificate, it can't be changed"))
+			return false
+		}
+		nick, _ := protocol.SplitArg(command.Args)
+		if err := protocol.ValidateNick(nick); err != nil {
+			manager.reply(client, notice("usage: /nick <name>: "+err.Error()))
+			return false
+		}
+		select {
+		case manager.nickCh <- &NickChange{client: client, nick: nick}:
+		case <-manager.done:
+		}
+	case protocol.CommandWho:
+		select {
+		case manager.whoCh <- client:
+		case <-manager.done:
+		}
+	case protocol.CommandMessage:
+		nick, body := protocol.SplitArg(command.Args)
+		if nick == "" || body == "" {
+			manager.reply(client, notice("usage: /msg <nick> <message>"))
+			return false
+		}
+		manager.publish(client, &protocol.Message{Kind: protocol.KindDirect, To: nick, Body: body})
+	case protocol.CommandFile:
+		target, body := protocol.SplitArg(command.Args)
+		if target == "" || body == "" {
+			manager.reply(client, notice("usage: /file <nick|#topic> <part>"))
+			return false
+		}
+		message := &protocol.Message{Kind: protocol.KindFile, To: target, Body: body}
+		if strings.HasPrefix(target, "#") {
+			message.To, message.Topic = "", strings.TrimPrefix(target, "#")
+			if err := protocol.ValidateTopic(message.Topic); err != nil {
+				manager.reply(client, notice("usage: /file <nick|#topic> <part>: "+err.Error()))
+				return false
+			}
+		}
+		manager.publish(client, message)
+	case protocol.CommandAction:
+		if command.Args == "" {
+			manager.reply(client, notice("usage: /me <action>"))
+			return false
+		}
+		manager.publish(client, &protocol.Message{Kind: protocol.KindAction, Topic: protocol.DefaultTopic, Body: command.Args})
+	case protocol.CommandHistory:
+		// without a sequence number it's everything still kept
+		var since uint64
+		if seq, _ := protocol.SplitArg(command.Args); seq != "" {
+			var err error
+			since, err = strconv.ParseUint(seq, 10, 64)
+			if err != nil {
+				manager.reply(client, notice("usage: /history [seq]: "+err.Error()))
+				return false
+			}
+		}
+		select {
+		case manager.historyCh <- &HistoryRequest{client: client, since: since}:
+		case <-manager.done:
+		}
+	case protocol.CommandPong:
+		// receiving anything resets the idle timeout, there's nothing else to do
+	case protocol.CommandQuit:
+		client.quitReason = command.Args
+		return true
+	default:
+		manager.reply(client, notice("unknown command: /"+command.Name))
+	}
+	return false
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/tlsconfig"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Federation links servers into one shared channel: every server relays the topic messages
+// published on it to its peers, which relay them further. A server drops its own messages,
+// the ones it has seen already and the ones that went through more than MaxHops links.
+// Presence and direct messages stay on their server, nicknames are only unique there.
+// Peers are only let in with a certificate over mutual TLS naming one of FederationPeers, or from the
+// networks of FederationAllow. Links are rate limited like clients, with limits of their own.
+
+// relayedTTL is how long a federated message is remembered to drop its duplicates.
+const relayedTTL = 10 * time.Minute
+
+// relayedPruneSize is how many remembered messages trigger a cleanup of the expired ones.
+const relayedPruneSize = 10000
+
+const (
+	minLinkBackoff = time.Second
+	maxLinkBackoff = time.Minute
+)
+
+// relayKey identifies a federated message, the time tells apart the sequence numbers
+// of a server that restarted without its message log.
+func relayKey(message *protocol.Message) string {
+	return message.Origin + "/" + strconv.FormatUint(message.OriginSeq, 10) + "/" + strconv.FormatInt(message.Time.UnixNano(), 10)
+}
+
+// remember returns false if the message was seen already.
+func (manager *ClientManager) remember(message *protocol.Message) bool {
+	key := relayKey(message)
+	if _, ok := manager.relayed[key]; ok {
+		return false
+	}
+	now := time.Now()
+	if len(manager.relayed) >= relayedPruneSize {
+		for key, seen := range manager.relayed {
+			if now.Sub(seen) > relayedTTL {
+				delete(manager.relayed, key)
+			}
+		}
+	}
+	manager.relayed[key] = now
+	return true
+}
+
+// acceptRelayed checks a message received from a link, it returns false if it must be dropped.
+func (manager *ClientManager) acceptRelayed(link *Client, message *protocol.Message) bool {
+	if message.Kind != protocol.KindMessage && message.Kind != protocol.KindAction {
+		return false
+	}
+	if message.Origin == "" || message.Origin == manager.config.ServerID || protocol.ValidateTopic(message.Topic) != nil {
+		return false
+	}
+	message.Hops++
+	if message.Hops > manager.config.MaxHops {
+		fmt.Printf("[FEDERATION]: Dropping message from %s after %d hops\n", message.Origin, message.Hops)
+		return false
+	}
+	if !manager.remember(message) {
+		return false
+	}
+	message.History = false
+	// the rest of the identity is whatever the peer says, only its nickname is kept,
+	// the origin is only vouched for by the link when it's the linked server itself
+	from := protocol.Identity{Server: message.Origin}
+	if message.Origin != link.link {
+		from.Via = link.link
+	}
+	if message.From != nil && protocol.ValidateNick(message.From.Nick) == nil {
+		from.Nick = message.From.Nick
+	}
+	message.From = &from
+	return true
+}
+
+// relay sends a topic message on to every link but the one it came from.
+func (manager *ClientManager) relay(from *Client, message *protocol.Message, frame []byte) {
+	if message.Origin == "" {
+		return
+	}
+	for client := range manager.clients {
+		if client.link != "" && client != from {
+			manager.deliverFrame(client, frame)
+		}
+	}
+}
+
+// receiveRelayed handles a frame read from a link, pings only keep the link alive.
+func (manager *ClientManager) receiveRelayed(link *Client, frame []byte) {
+	message, err := protocol.UnmarshalMessage(frame)
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "decode relayed message error"))
+		return
+	}
+	if message.Kind != protocol.KindMessage && message.Kind != protocol.KindAction {
+		return
+	}
+	manager.publish(link, message)
+}
+
+// handleLink runs the accepting side of a federation link, which starts with "/link <server id>".
+func (server *Server) handleLink(conn net.Conn) {
+	identity := protocol.Identity{Addr: conn.RemoteAddr().String()}
+	if !server.linkAllowed(conn.RemoteAddr()) {
+		fmt.Println("[REJECTED]: Link not allowed from " + identity.Addr)
+		conn.Close()
+		return
+	}
+	if server.TLSConfig != nil {
+		tlsConn := tls.Server(conn, server.TLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			fmt.Println("[REJECTED]: TLS handshake with peer " + identity.Addr + " failed: " + err.Error())
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		identity.CommonName = tlsconfig.PeerName(tlsConn)
+		conn = tlsConn
+	}
+	reader := protocol.NewReader(conn, server.manager.config.Framing, server.manager.config.MaxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "read link handshake error"))
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	var peerID string
+	if command, ok := protocol.ParseCommand(string(frame)); ok && command.Name == protocol.CommandLink {
+		peerID, _ = protocol.SplitArg(command.Args)
+	}
+	if peerID == "" {
+		fmt.Println("[REJECTED]: Not a link handshake from " + identity.Addr)
+		conn.Close()
+		return
+	}
+	if peerID == server.manager.config.ServerID {
+		fmt.Println("[REJECTED]: Link to itself from " + identity.Addr)
+		conn.Close()
+		return
+	}
+	// the chat users may have certificates from the same CA, a peer has to be one of the known servers
+	if (identity.CommonName != "" || len(server.FederationAllow) == 0) &&
+		(identity.CommonName != peerID || !server.FederationPeers[peerID]) {
+		fmt.Println("[REJECTED]: Link as " + peerID + " not allowed for " + identity.String())
+		conn.Close()
+		return
+	}
+
+	client := server.manager.newLink(conn, identity, peerID)
+	// the reader may have buffered what the peer sent right after the handshake
+	client.reader = reader
+	if !server.run(client, false) {
+		conn.Close()
+	}
+}
+
+// linkAllowed tells if a peer server can link from addr, without FederationAllow it has to
+// authenticate with a certificate naming one of FederationPeers.
+func (server *Server) linkAllowed(addr net.Addr) bool {
+	if len(server.FederationAllow) == 0 {
+		return len(server.FederationPeers) > 0 && server.TLSConfig != nil && server.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range server.FederationAllow {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses a comma-separated list of IPs and CIDR networks, like "10.0.0.1,192.168.0.0/16".
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, errors.New("invalid IP " + field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid network "+field)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// dialLink connects to the federation listener of a peer, over TLS if LinkTLSConfig is set.
+func (server *Server) dialLink(ctx context.Context, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil || server.LinkTLSConfig == nil {
+		return conn, err
+	}
+	config := server.LinkTLSConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "TLS handshake error")
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// linkPeer keeps a federation link to a peer open until ctx is done, reconnecting with backoff.
+func (server *Server) linkPeer(ctx context.Context, address string) {
+	backoff := minLinkBackoff
+	for {
+		conn, err := server.dialLink(ctx, address)
+		if err == nil {
+			writer := protocol.NewWriter(conn, server.manager.config.Framing, server.manager.config.MaxFrameSize)
+			err = writer.WriteFrame([]byte("/" + protocol.CommandLink + " " + server.manager.config.ServerID))
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			backoff = minLinkBackoff
+			client := server.manager.newLink(conn, protocol.Identity{Addr: address}, address)
+			if !server.manager.register(client) {
+				conn.Close()
+				return
+			}
+			server.connections.Add(1)
+			go func() {
+				defer server.connections.Done()
+				server.manager.send(client)
+			}()
+			server.manager.receive(client)
+		} else if ctx.Err() == nil {
+			fmt.Println(errors.Wrap(err, "link to peer "+address+" error"))
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxLinkBackoff {
+			backoff = maxLinkBackoff
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// startFederation starts a server accepting links from the networks in allow.
+func startFederation(t *testing.T, allow string, config ManagerConfig) (*testServer, string) {
+	t.Helper()
+	networks, err := parseNetworks(allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	federationListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ServerID, config.MaxHops = "local", 8
+	server := startServer(t, config, func(server *Server) {
+		server.FederationListener = federationListener
+		server.FederationAllow = networks
+	})
+	return server, federationListener.Addr().String()
+}
+
+// dialLink links to the server as the peer server id.
+func dialLink(t *testing.T, address, id string) (net.Conn, *protocol.Writer) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	writer := protocol.NewWriter(conn, protocol.FramingLine, 0)
+	if err := writer.WriteFrame([]byte("/" + protocol.CommandLink + " " + id)); err != nil {
+		t.Fatal(err)
+	}
+	return conn, writer
+}
+
+// expectLinkClosed fails unless the server closes the link.
+func expectLinkClosed(t *testing.T, conn net.Conn, why string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected %s to be refused", why)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatalf("expected %s to be closed, it's still open", why)
+	}
+}
+
+func TestLinkNotAllowed(t *testing.T) {
+	for _, allow := range []string{"", "10.0.0.0/8"} {
+		_, address := startFederation(t, allow, ManagerConfig{})
+		conn, _ := dialLink(t, address, "peer")
+		expectLinkClosed(t, conn, "a link from outside "+allow)
+	}
+}
+
+func TestRelayedIdentity(t *testing.T) {
+	server, address := startFederation(t, "127.0.0.1", ManagerConfig{})
+	client := dialServer(t, server)
+	_, writer := dialLink(t, address, "peer")
+
+	message := &protocol.Message{
+		Kind:      protocol.KindMessage,
+		Time:      time.Now(),
+		Topic:     protocol.DefaultTopic,
+		Body:      "hello from afar",
+		Origin:    "peer",
+		OriginSeq: 1,
+		From: &protocol.Identity{
+			Nick:       "mallory",
+			Addr:       "10.0.0.1:1234",
+			CommonName: "admin",
+			Cred:       &protocol.Credentials{UID: 0, GID: 0, PID: 1},
+		},
+	}
+	frame, err := message.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	relayed := client.expect(t, protocol.KindMessage, "hello from afar")
+	expected := protocol.Identity{Nick: "mallory", Server: "peer"}
+	if relayed.From == nil || *relayed.From != expected {
+		t.Fatalf("expected only the nickname and the origin of a relayed identity, got %+v", relayed.From)
+	}
+	if relayed.From.String() != "mallory@peer" {
+		t.Fatalf("expected a relayed identity to show its server, got %q", relayed.From.String())
+	}
+
+	// the peer can only vouch for itself, the messages it relays from further away show it
+	message.Origin = "far"
+	message.Body = "hello from further"
+	frame, err = message.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	relayed = client.expect(t, protocol.KindMessage, "hello from further")
+	expected = protocol.Identity{Nick: "mallory", Server: "far", Via: "peer"}
+	if relayed.From == nil || *relayed.From != expected {
+		t.Fatalf("expected the link a relayed identity came through, got %+v", relayed.From)
+	}
+	if relayed.From.String() != "mallory@far via peer" {
+		t.Fatalf("expected a relayed identity to show the link, got %q", relayed.From.String())
+	}
+}
+
+func TestLinkRateLimits(t *testing.T) {
+	server, address := startFederation(t, "127.0.0.1", ManagerConfig{
+		RateLimits:     RateLimits{MessageRate: 1000, MessageBurst: 1000, Action: ActionDrop},
+		LinkRateLimits: RateLimits{MessageRate: 0.001, MessageBurst: 1, Action: ActionDrop},
+	})
+	client := dialServer(t, server)
+	_, writer := dialLink(t, address, "peer")
+	for seq := uint64(1); seq <= 3; seq++ {
+		message := &protocol.Message{Kind: protocol.KindMessage, Time: time.Now(), Topic: protocol.DefaultTopic, Body: "relayed", Origin: "peer", OriginSeq: seq}
+		frame, err := message.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.expect(t, protocol.KindMessage, "relayed")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, info := range clientInfos(server.manager) {
+			if info.Link == "peer" && info.Limited == 2 {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected the link to be limited to its burst, got %+v", clientInfos(server.manager))
+}
+
+// testCertificates issues a certificate for 127.0.0.1 usable by both ends of a link for every
+// common name in names, signed by a new CA.
+func testCertificates(t *testing.T, names ...string) ([]tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certs []tls.Certificate
+	for i, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i) + 2),
+			Subject:      pkix.Name{CommonName: name},
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return certs, pool
+}
+
+func TestLinkMutualTLS(t *testing.T) {
+	certs, pool := testCertificates(t, "accepting", "linking", "alice")
+	federationListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepting := startServer(t, ManagerConfig{ServerID: "accepting", MaxHops: 8}, func(server *Server) {
+		server.TLSConfig = &tls.Config{
+			Certificates: certs[:1],
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+		server.FederationListener = federationListener
+		server.FederationPeers = map[string]bool{"linking": true}
+	})
+	address := federationListener.Addr().String()
+
+	// a peer without a certificate doesn't get in
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: pool})
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("expected a peer without a certificate to be refused")
+	}
+
+	// neither does a chat user with a certificate from the same CA, nor a peer linking as another
+	for _, c := range []struct {
+		cert tls.Certificate
+		id   string
+	}{
+		{certs[2], "alice"},
+		{certs[1], "other"},
+	} {
+		conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{c.cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := protocol.NewWriter(conn, protocol.FramingLine, 0).WriteFrame([]byte("/" + protocol.CommandLink + " " + c.id)); err != nil {
+			t.Fatal(err)
+		}
+		expectLinkClosed(t, conn, "a link as "+c.id)
+	}
+
+	startServer(t, ManagerConfig{ServerID: "linking", MaxHops: 8}, func(server *Server) {
+		server.Peers = []string{address}
+		server.LinkTLSConfig = &tls.Config{Certificates: certs[1:2], RootCAs: pool}
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, info := range clientInfos(accepting.manager) {
+			if info.Link == "linking" {
+				if info.CommonName != "linking" {
+					t.Fatalf("expected the link to be authenticated by its certificate, got %+v", info)
+				}
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the peer with a certificate didn't link")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/websocket"
+	"net/http"
+)
+
+//go:embed gateway.html
+var gatewayPage []byte
+
+// webSocketFrames carries the frames of a client as WebSocket messages, one frame per message.
+type webSocketFrames struct {
+	conn *websocket.Conn
+}
+
+func (frames webSocketFrames) ReadFrame() ([]byte, error) {
+	return frames.conn.ReadMessage()
+}
+
+func (frames webSocketFrames) WriteFrame(frame []byte) error {
+	return frames.conn.WriteMessage(frame)
+}
+
+func (manager *ClientManager) newWebSocketClient(conn *websocket.Conn, identity protocol.Identity) *Client {
+	client := manager.newClient(conn, identity)
+	client.reader = webSocketFrames{conn: conn}
+	client.writer = webSocketFrames{conn: conn}
+	return client
+}
+
+// gateway serves the chat page on "/" and lets browsers in as clients on "/ws".
+func (server *Server) gateway() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(gatewayPage)
+	})
+	mux.HandleFunc("/ws", server.handleWebSocket)
+	return mux
+}
+
+func (server *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	identity := protocol.Identity{Addr: r.RemoteAddr}
+	// browsers come over tcp, they have no peer credentials to check the allowlist against
+	if !server.allowlist.Allowed(identity.Cred) {
+		fmt.Println("[REJECTED]: Client not allowed: " + identity.String())
+		http.Error(w, "not allowed", http.StatusForbidden)
+		return
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		identity.CommonName = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if err := server.admit(identity); err != nil {
+		fmt.Println("[REJECTED]: Client refused, " + err.Error() + ": " + identity.String())
+		http.Error(w, "connection refused: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r, server.manager.config.MaxFrameSize)
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "websocket upgrade error"))
+		server.manager.guard.Release(peerKey(identity))
+		return
+	}
+	client := server.manager.newWebSocketClient(conn, identity)
+	if !server.run(client, true) {
+		conn.Close()
+	}
+}
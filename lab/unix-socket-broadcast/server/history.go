@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"sort"
+)
+
+// History keeps the most recent messages of every topic in a ring buffer,
+// it's only touched by the manager goroutine.
+type History struct {
+	size   int
+	topics map[string]*ring
+}
+
+type ring struct {
+	messages []*protocol.Message
+	// next is where the next message goes, once the ring is full it's also the oldest message
+	next int
+	full bool
+}
+
+func NewHistory(size int) *History {
+	return &History{size: size, topics: make(map[string]*ring)}
+}
+
+func (history *History) Add(message *protocol.Message) {
+	if history.size <= 0 {
+		return
+	}
+	r, ok := history.topics[message.Topic]
+	if !ok {
+		r = &ring{messages: make([]*protocol.Message, history.size)}
+		history.topics[message.Topic] = r
+	}
+	r.messages[r.next] = message
+	r.next = (r.next + 1) % len(r.messages)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Since returns the messages after seq in topics matching any of the patterns, oldest first.
+func (history *History) Since(patterns map[string]bool, seq uint64) []*protocol.Message {
+	var messages []*protocol.Message
+	for topic, r := range history.topics {
+		if !matchAny(patterns, topic) {
+			continue
+		}
+		for _, message := range r.ordered() {
+			if message.Seq > seq {
+				messages = append(messages, message)
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Seq < messages[j].Seq })
+	return messages
+}
+
+func (r *ring) ordered() []*protocol.Message {
+	if !r.full {
+		return r.messages[:r.next]
+	}
+	return append(append([]*protocol.Message{}, r.messages[r.next:]...), r.messages[:r.next]...)
+}
+
+func matchAny(patterns map[string]bool, topic string) bool {
+	for pattern := range patterns {
+		if protocol.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// replayRecent sends a newly joined client the last n messages in the topics it subscribes to.
+func (manager *ClientManager) replayRecent(client *Client, n int) {
+	if room := manager.room(client); n > room {
+		n = room
+	}
+	if n <= 0 {
+		return
+	}
+	messages := manager.history.Since(client.patterns, 0)
+	if len(messages) > n {
+		messages = messages[len(messages)-n:]
+	}
+	manager.replay(client, messages)
+}
+
+// replaySince sends a client the messages after seq in the topics it subscribes to, oldest first.
+// If they don't fit in its queue, it's told where to continue from.
+func (manager *ClientManager) replaySince(client *Client, seq uint64) {
+	messages := manager.history.Since(client.patterns, seq)
+	if len(messages) == 0 {
+		manager.deliver(client, notice(fmt.Sprintf("no history after %d", seq)))
+		return
+	}
+	// keep a slot for the notice telling where to continue from
+	room := manager.room(client) - 1
+	if room <= 0 {
+		return
+	}
+	if len(messages) > room {
+		manager.replay(client, messages[:room])
+		last := messages[room-1].Seq
+		manager.deliver(client, notice(fmt.Sprintf("%d more messages, use /history %d to get them", len(messages)-room, last)))
+		return
+	}
+	manager.replay(client, messages)
+}
+
+func (manager *ClientManager) replay(client *Client, messages []*protocol.Message) {
+	for _, message := range messages {
+		replayed := *message
+		replayed.History = true
+		manager.deliver(client, &replayed)
+	}
+}
+
+// room is how many messages can be queued for a client without overflowing.
+func (manager *ClientManager) room(client *Client) int {
+	return cap(client.data) - len(client.data)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"testing"
+)
+
+func historyMessage(seq uint64, topic string) *protocol.Message {
+	return &protocol.Message{Kind: protocol.KindMessage, Seq: seq, Topic: topic}
+}
+
+func seqs(messages []*protocol.Message) string {
+	s := ""
+	for _, message := range messages {
+		s += fmt.Sprintf("%d ", message.Seq)
+	}
+	return s
+}
+
+func TestHistoryRing(t *testing.T) {
+	for _, c := range []struct {
+		added    int
+		expected string
+	}{
+		{0, ""},
+		{2, "1 2 "},
+		{3, "1 2 3 "},
+		// the oldest are overwritten
+		{4, "2 3 4 "},
+		{7, "5 6 7 "},
+	} {
+		history := NewHistory(3)
+		for seq := 1; seq <= c.added; seq++ {
+			history.Add(historyMessage(uint64(seq), "news"))
+		}
+		if got := seqs(history.Since(map[string]bool{"news": true}, 0)); got != c.expected {
+			t.Fatalf("%d added: expected %q, got %q", c.added, c.expected, got)
+		}
+	}
+
+	history := NewHistory(0)
+	history.Add(historyMessage(1, "news"))
+	if messages := history.Since(map[string]bool{">": true}, 0); len(messages) != 0 {
+		t.Fatalf("expected no history without a size, got %q", seqs(messages))
+	}
+}
+
+func TestHistorySince(t *testing.T) {
+	history := NewHistory(3)
+	topics := []string{"news.sports", "weather", "news.tech", "news.sports", "weather", "news.sports", "news.sports", "news.tech"}
+	for i, topic := range topics {
+		history.Add(historyMessage(uint64(i+1), topic))
+	}
+
+	for _, c := range []struct {
+		patterns []string
+		since    uint64
+		expected string
+	}{
+		// every topic keeps its own ring, the replay is ordered across them
+		{[]string{">"}, 0, "2 3 4 5 6 7 8 "},
+		{[]string{"news.>"}, 0, "3 4 6 7 8 "},
+		{[]string{"news.sports", "weather"}, 0, "2 4 5 6 7 "},
+		{[]string{"news.*"}, 5, "6 7 8 "},
+		{[]string{"weather"}, 5, ""},
+		{[]string{"sports"}, 0, ""},
+	} {
+		patterns := make(map[string]bool)
+		for _, pattern := range c.patterns {
+			patterns[pattern] = true
+		}
+		if got := seqs(history.Since(patterns, c.since)); got != c.expected {
+			t.Fatalf("%q since %d: expected %q, got %q", c.patterns, c.since, c.expected, got)
+		}
+	}
+}
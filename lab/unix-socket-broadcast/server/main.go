@@ -1,103 +1,241 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/spongeprojects/magicconch"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/tlsconfig"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/wal"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-type ClientManager struct {
-	clients      map[*Client]bool
-	broadcastCh  chan []byte
-	registerCh   chan *Client
-	unregisterCh chan *Client
-}
-
-type Client struct {
-	socket net.Conn
-	data   chan []byte
-}
+func main() {
+	framingFlag := flag.String("framing", string(protocol.FramingLength), "message framing: length or line (for netcat)")
+	maxFrameSize := flag.Int("max-frame-size", protocol.DefaultMaxFrameSize, "max size of a single message in bytes")
+	queueSize := flag.Int("queue-size", 64, "max outgoing messages queued for a client")
+	overflowPolicyFlag := flag.String("overflow-policy", string(PolicyDropOldest), "what to do when a client's queue is full: drop-oldest, drop-newest, block or disconnect")
+	blockTimeout := flag.Duration("block-timeout", 100*time.Millisecond, "how long the block overflow policy waits")
+	historySize := flag.Int("history-size", 100, "recent messages kept for every topic")
+	historyReplay := flag.Int("history-replay", 10, "recent messages sent to a client when it joins")
+	walDir := flag.String("wal-dir", "", "directory to persist messages in, messages are not persisted if empty")
+	walSegmentSize := flag.Int64("wal-segment-size", 4*1024*1024, "size in bytes of a message log segment")
+	walMaxSize := flag.Int64("wal-max-size", 0, "total size in bytes of message log segments to keep, 0 means no limit")
+	walMaxAge := flag.Duration("wal-max-age", 0, "remove message log segments older than this, 0 means no limit")
+	walSync := flag.Bool("wal-sync", false, "fsync the message log after every message")
+	walCompactInterval := flag.Duration("wal-compact-interval", 10*time.Minute, "how often to compact the message log down to the history, 0 means never")
+	network := flag.String("network", "tcp", "network to listen on: tcp or unix")
+	address := flag.String("address", ":12345", "address to listen on, a file path for unix")
+	allowUIDs := flag.String("allow-uids", "", "comma-separated UIDs allowed to connect, unix only")
+	allowGIDs := flag.String("allow-gids", "", "comma-separated GIDs allowed to connect, unix only")
+	pingInterval := flag.Duration("ping-interval", 20*time.Second, "how often clients are pinged, 0 means never")
+	idleTimeout := flag.Duration("idle-timeout", time.Minute, "disconnect clients that sent nothing for this long, pongs included, 0 means never")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "disconnect clients that take longer than this to take a message, 0 means never")
+	tlsCert := flag.String("tls-cert", "", "server certificate file, enables TLS")
+	tlsKey := flag.String("tls-key", "", "server private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file to verify client certificates with, requires clients to present one, their common name becomes their nickname")
+	serverID := flag.String("server-id", "", "ID of the server in the federation, unique among its peers, the host name and the process ID if empty")
+	federationAddress := flag.String("federation-address", "", "address to accept links from peer servers on, like :12346, disabled if empty")
+	federationAllow := flag.String("federation-allow", "", "comma-separated IPs and networks like 10.0.0.0/8 peer servers can link from, required unless -federation-peers is set")
+	federationPeers := flag.String("federation-peers", "", "comma-separated IDs of the peer servers that can link with a certificate verified by -tls-client-ca, whose common name has to be their ID")
+	peers := flag.String("peers", "", "comma-separated federation addresses of the peer servers to link to")
+	maxHops := flag.Int("max-hops", 8, "how many links a federated message can go through")
+	messageRate := flag.Float64("message-rate", 20, "messages a client can send per second, 0 means no limit")
+	messageBurst := flag.Int("message-burst", 50, "messages a client can send at once")
+	byteRate := flag.Float64("byte-rate", 256*1024, "bytes a client can send per second, 0 means no limit")
+	byteBurst := flag.Int("byte-burst", 1024*1024, "bytes a client can send at once")
+	linkMessageRate := flag.Float64("link-message-rate", 1000, "messages a federation link can relay per second, 0 means no limit")
+	linkMessageBurst := flag.Int("link-message-burst", 2000, "messages a federation link can relay at once")
+	linkByteRate := flag.Float64("link-byte-rate", 4*1024*1024, "bytes a federation link can relay per second, 0 means no limit")
+	linkByteBurst := flag.Int("link-byte-burst", 16*1024*1024, "bytes a federation link can relay at once")
+	rateLimitActionFlag := flag.String("rate-limit-action", string(ActionThrottle), "what to do with a client over its rate limits: throttle, drop, disconnect or ban")
+	banDuration := flag.Duration("ban-duration", time.Minute, "how long the ban rate limit action refuses a peer")
+	maxClients := flag.Int("max-clients", 1000, "max number of connected clients, 0 means no limit")
+	maxConnectionsPerPeer := flag.Int("max-connections-per-peer", 0, "max number of clients from the same IP address or unix user, 0 means no limit")
+	adminAddress := flag.String("admin-address", "", "address to serve the metrics on /metrics and the admin operations on /clients and /kick, like localhost:9090, disabled if empty, bind it to loopback: anybody who can reach it can see the clients")
+	adminTokenFile := flag.String("admin-token-file", "", "file with the token /kick requires as \"Authorization: Bearer <token>\", /kick takes no token if empty")
+	gatewayAddress := flag.String("gateway-address", "", "address to serve the WebSocket gateway and its chat page on, like :8080, disabled if empty")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "how long clients get to receive queued messages when shutting down")
+	flag.Parse()
 
-func (manager *ClientManager) start() {
-	for {
-		select {
-		case client := <-manager.registerCh:
-			manager.clients[client] = true
-			fmt.Println("[REGISTERED]: Client registered!")
-		case client := <-manager.unregisterCh:
-			if _, ok := manager.clients[client]; ok {
-				close(client.data)
-				delete(manager.clients, client)
-				fmt.Println("[UNREGISTERED]: Client unregistered!")
-			}
-		case message := <-manager.broadcastCh:
-			fmt.Println("[BROADCASTING]: " + string(message))
-			for client := range manager.clients {
-				select {
-				case client.data <- message:
-				default:
-					close(client.data)
-					delete(manager.clients, client)
-				}
-			}
-		}
+	framing, err := protocol.ParseFraming(*framingFlag)
+	magicconch.Must(err)
+	overflowPolicy, err := ParseOverflowPolicy(*overflowPolicyFlag)
+	magicconch.Must(err)
+	rateLimitAction, err := ParseRateLimitAction(*rateLimitActionFlag)
+	magicconch.Must(err)
+	rateLimits := RateLimits{
+		MessageRate:  *messageRate,
+		MessageBurst: *messageBurst,
+		ByteRate:     *byteRate,
+		ByteBurst:    *byteBurst,
+		Action:       rateLimitAction,
 	}
-}
-
-func (manager *ClientManager) receive(client *Client) {
-	for {
-		message := make([]byte, 4096)
-		length, err := client.socket.Read(message)
-		if err != nil {
-			manager.unregisterCh <- client
-			client.socket.Close()
-			break
-		}
-		if length > 0 {
-			fmt.Println("[RECEIVED]: " + string(message))
-			manager.broadcastCh <- message
-		}
+	magicconch.Must(rateLimits.Validate())
+	// a link relays the messages of a whole server, it's slowed down rather than cut off
+	linkRateLimits := RateLimits{
+		MessageRate:  *linkMessageRate,
+		MessageBurst: *linkMessageBurst,
+		ByteRate:     *linkByteRate,
+		ByteBurst:    *linkByteBurst,
+		Action:       ActionThrottle,
 	}
-}
-
-func (manager *ClientManager) send(client *Client) {
-	defer client.socket.Close()
-	for {
-		select {
-		case message, ok := <-client.data:
-			if !ok {
-				return
-			}
-			client.socket.Write(message)
+	magicconch.Must(linkRateLimits.Validate())
+	uids, err := parseIDs(*allowUIDs)
+	magicconch.Must(err)
+	gids, err := parseIDs(*allowGIDs)
+	magicconch.Must(err)
+	allowlist := NewPeerAllowlist(uids, gids)
+	if !allowlist.Empty() && *network != "unix" {
+		// only unix sockets have peer credentials, everybody would be refused
+		magicconch.Must(errors.New("-allow-uids and -allow-gids require -network unix"))
+	}
+	if !allowlist.Empty() && *gatewayAddress != "" {
+		// the gateway is served over tcp, it would let in anybody the allowlist keeps out
+		magicconch.Must(errors.New("-gateway-address can't be used with -allow-uids or -allow-gids"))
+	}
+	var tlsConfig, linkTLSConfig *tls.Config
+	if *tlsCert != "" {
+		tlsConfig, err = tlsconfig.Server(*tlsCert, *tlsKey, *tlsClientCA)
+		magicconch.Must(err)
+		// peers are verified with the client CA, the server certificate is presented to them
+		linkTLSConfig, err = tlsconfig.Client(*tlsClientCA, *tlsCert, *tlsKey, "")
+		magicconch.Must(err)
+	} else if *tlsClientCA != "" {
+		magicconch.Must(errors.New("-tls-client-ca requires -tls-cert"))
+	}
+	federationNetworks, err := parseNetworks(*federationAllow)
+	magicconch.Must(err)
+	peerIDs := make(map[string]bool)
+	for _, id := range strings.Split(*federationPeers, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			peerIDs[id] = true
 		}
 	}
-}
+	if len(peerIDs) > 0 && *tlsClientCA == "" {
+		magicconch.Must(errors.New("-federation-peers requires -tls-client-ca"))
+	}
+	if *federationAddress != "" && len(federationNetworks) == 0 && len(peerIDs) == 0 {
+		// anybody could link in and publish as anybody, or anybody with a client certificate
+		magicconch.Must(errors.New("-federation-address requires -federation-peers or -federation-allow"))
+	}
 
-func main() {
 	fmt.Println("Starting server...")
 
-	listener, err := net.Listen("tcp", ":12345")
+	listeners, err := socketserver.InheritListeners()
 	magicconch.Must(err)
+	// after a hot restart, the old process closes the message log before this one opens it
+	listeners.WaitHandover()
 
-	manager := ClientManager{
-		clients:      make(map[*Client]bool),
-		broadcastCh:  make(chan []byte),
-		registerCh:   make(chan *Client),
-		unregisterCh: make(chan *Client),
+	var messageLog *wal.Log
+	if *walDir != "" {
+		messageLog, err = wal.Open(wal.Options{
+			Dir:         *walDir,
+			SegmentSize: *walSegmentSize,
+			MaxSize:     *walMaxSize,
+			MaxAge:      *walMaxAge,
+			Sync:        *walSync,
+		})
+		magicconch.Must(err)
+		defer messageLog.Close()
 	}
 
-	go manager.start()
+	listener, err := listeners.Listen("broadcast", *network, *address)
+	magicconch.Must(err)
+
+	var adminListener net.Listener
+	if *adminAddress != "" {
+		adminListener, err = listeners.Listen("admin", "tcp", *adminAddress)
+		magicconch.Must(err)
+	}
+	var adminToken string
+	if *adminTokenFile != "" {
+		data, err := os.ReadFile(*adminTokenFile)
+		magicconch.Must(errors.Wrap(err, "read admin token error"))
+		adminToken = strings.TrimSpace(string(data))
+		if adminToken == "" {
+			magicconch.Must(errors.New(*adminTokenFile + " holds no admin token"))
+		}
+	}
+	var gatewayListener net.Listener
+	if *gatewayAddress != "" {
+		gatewayListener, err = listeners.Listen("gateway", "tcp", *gatewayAddress)
+		magicconch.Must(err)
+	}
 
-	fmt.Println("[WAITING]")
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println(errors.Wrap(err, "accept connection error"))
+	var federationListener net.Listener
+	if *federationAddress != "" {
+		federationListener, err = listeners.Listen("federation", "tcp", *federationAddress)
+		magicconch.Must(err)
+	}
+	listeners.Close()
+	var peerAddresses []string
+	for _, peer := range strings.Split(*peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peerAddresses = append(peerAddresses, peer)
 		}
-		client := &Client{socket: conn, data: make(chan []byte)}
-		manager.registerCh <- client
-		go manager.receive(client)
-		go manager.send(client)
 	}
+	// messages only carry their origin when there is a federation
+	if *serverID == "" && (federationListener != nil || len(peerAddresses) > 0) {
+		hostname, err := os.Hostname()
+		magicconch.Must(err)
+		*serverID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	manager := NewClientManager(ManagerConfig{
+		Framing:               framing,
+		MaxFrameSize:          *maxFrameSize,
+		QueueSize:             *queueSize,
+		OverflowPolicy:        overflowPolicy,
+		BlockTimeout:          *blockTimeout,
+		HistorySize:           *historySize,
+		HistoryReplay:         *historyReplay,
+		MessageLog:            messageLog,
+		CompactInterval:       *walCompactInterval,
+		PingInterval:          *pingInterval,
+		IdleTimeout:           *idleTimeout,
+		WriteTimeout:          *writeTimeout,
+		ServerID:              *serverID,
+		MaxHops:               *maxHops,
+		RateLimits:            rateLimits,
+		LinkRateLimits:        linkRateLimits,
+		MaxClients:            *maxClients,
+		MaxConnectionsPerPeer: *maxConnectionsPerPeer,
+		BanDuration:           *banDuration,
+	})
+	magicconch.Must(manager.restore())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// SIGHUP starts a new server on the same listeners and shuts this one down, without refusing anybody
+	listeners.RestartOnHangup(stop)
+
+	server := NewServer(listener, manager, allowlist)
+	server.ShutdownTimeout = *shutdownTimeout
+	server.TLSConfig = tlsConfig
+	server.GatewayListener = gatewayListener
+	server.AdminListener = adminListener
+	server.AdminToken = adminToken
+	server.FederationListener = federationListener
+	server.FederationAllow = federationNetworks
+	server.FederationPeers = peerIDs
+	server.Peers = peerAddresses
+	server.LinkTLSConfig = linkTLSConfig
+	if err := server.Serve(ctx); err != nil {
+		fmt.Println(err)
+	}
+	// nothing is written to the message log anymore, the new process of a hot restart can have it
+	if messageLog != nil {
+		messageLog.Close()
+	}
+	listeners.HandOver()
 }
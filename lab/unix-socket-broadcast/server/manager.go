@@ -0,0 +1,536 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/wal"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type ClientManager struct {
+	clients map[*Client]bool
+	// subscriptions maps a topic or a wildcard pattern to its subscribers
+	subscriptions map[string]map[*Client]bool
+	// nicks maps lower-cased nicknames to their clients
+	nicks        map[string]*Client
+	guestCounter int
+	history      *History
+	// seq is the sequence number of the last message published to a topic
+	seq           uint64
+	broadcastCh   chan *Publication
+	registerCh    chan *Client
+	unregisterCh  chan *Client
+	subscribeCh   chan *Subscription
+	unsubscribeCh chan *Subscription
+	nickCh        chan *NickChange
+	whoCh         chan *Client
+	historyCh     chan *HistoryRequest
+	replyCh       chan *Reply
+	clientsCh     chan chan []ClientInfo
+	kickCh        chan *Kick
+	shutdownCh    chan time.Time
+	// shutdownDeadline is set before done is closed
+	shutdownDeadline time.Time
+	// metrics counts what goes through the server, for the admin endpoint
+	metrics *Metrics
+	// guard enforces the connection limits and the bans
+	guard *Guard
+	// compacting is set while the message log is compacted in the background, accessed atomically
+	compacting int32
+	// relayed has the federated messages seen recently, to drop the ones coming back through another link
+	relayed map[string]time.Time
+	// done is closed once the manager has shut down, nobody is listening on the channels after that
+	done   chan struct{}
+	config ManagerConfig
+}
+
+type ManagerConfig struct {
+	Framing      protocol.Framing
+	MaxFrameSize int
+	// QueueSize is how many outgoing messages can be queued for a client
+	QueueSize int
+	// OverflowPolicy decides what happens when a client's queue is full
+	OverflowPolicy OverflowPolicy
+	// BlockTimeout is how long PolicyBlock waits for a full queue before dropping the message
+	BlockTimeout time.Duration
+	// HistorySize is how many recent messages are kept for every topic
+	HistorySize int
+	// HistoryReplay is how many recent messages a client gets when it joins
+	HistoryReplay int
+	// MessageLog persists messages published to topics, it can be nil
+	MessageLog *wal.Log
+	// CompactInterval is how often MessageLog is compacted down to the history, 0 means never
+	CompactInterval time.Duration
+	// PingInterval is how often clients are pinged, 0 means never
+	PingInterval time.Duration
+	// IdleTimeout disconnects a client that sent nothing, not even a pong, for this long, 0 means never
+	IdleTimeout time.Duration
+	// WriteTimeout disconnects a client that takes longer than this to take a message, 0 means never
+	WriteTimeout time.Duration
+	// ServerID identifies the server in the federation, messages are not federated if it's empty
+	ServerID string
+	// MaxHops is how many links a federated message can go through
+	MaxHops int
+	// RateLimits apply to what every client sends, federation links excepted
+	RateLimits RateLimits
+	// LinkRateLimits apply to what every federation link relays
+	LinkRateLimits RateLimits
+	// MaxClients and MaxConnectionsPerPeer limit the connected clients, 0 means no limit
+	MaxClients            int
+	MaxConnectionsPerPeer int
+	// BanDuration is how long ActionBan refuses a peer
+	BanDuration time.Duration
+}
+
+type Client struct {
+	socket net.Conn
+	// identity is only touched by the manager goroutine once the client is registered
+	identity protocol.Identity
+	// reader and writer carry the frames over a socket or a WebSocket
+	reader socketserver.FrameReader
+	writer socketserver.FrameWriter
+	data   chan []byte
+	// dropped counts messages discarded because data was full, accessed atomically
+	dropped uint64
+	// patterns the client subscribed to, only touched by the manager goroutine
+	patterns map[string]bool
+	// quitReason is set by "/quit" before the client is unregistered
+	quitReason string
+	// connectedAt is when the client connected, for the connection duration metrics
+	connectedAt time.Time
+	// link is the ID or the address of the peer server if the client is a federation link
+	link string
+	// the buckets are only touched by the receive goroutine, limitNoticed too
+	messageBucket *tokenBucket
+	byteBucket    *tokenBucket
+	limitNoticed  bool
+	// limited counts frames over the rate limits, accessed atomically
+	limited uint64
+}
+
+// Publication is a message from a client, the manager fills in the sender and the time.
+type Publication struct {
+	client  *Client
+	message *protocol.Message
+}
+
+type Subscription struct {
+	client  *Client
+	pattern string
+}
+
+// HistoryRequest asks for the messages after a sequence number, for a client catching up after reconnecting.
+type HistoryRequest struct {
+	client *Client
+	since  uint64
+}
+
+type NickChange struct {
+	client *Client
+	nick   string
+}
+
+// Reply is a message sent only to the client that issued a command.
+type Reply struct {
+	client  *Client
+	message *protocol.Message
+}
+
+func NewClientManager(config ManagerConfig) *ClientManager {
+	return &ClientManager{
+		clients:       make(map[*Client]bool),
+		subscriptions: make(map[string]map[*Client]bool),
+		nicks:         make(map[string]*Client),
+		history:       NewHistory(config.HistorySize),
+		broadcastCh:   make(chan *Publication),
+		registerCh:    make(chan *Client),
+		unregisterCh:  make(chan *Client),
+		subscribeCh:   make(chan *Subscription),
+		unsubscribeCh: make(chan *Subscription),
+		nickCh:        make(chan *NickChange),
+		whoCh:         make(chan *Client),
+		historyCh:     make(chan *HistoryRequest),
+		replyCh:       make(chan *Reply),
+		clientsCh:     make(chan chan []ClientInfo),
+		kickCh:        make(chan *Kick),
+		shutdownCh:    make(chan time.Time),
+		relayed:       make(map[string]time.Time),
+		metrics:       NewMetrics(),
+		guard:         NewGuard(config.MaxClients, config.MaxConnectionsPerPeer, config.BanDuration),
+		done:          make(chan struct{}),
+		config:        config,
+	}
+}
+
+func (manager *ClientManager) newClient(conn net.Conn, identity protocol.Identity) *Client {
+	return &Client{
+		socket:   conn,
+		identity: identity,
+		reader:   protocol.NewReader(conn, manager.config.Framing, manager.config.MaxFrameSize),
+		writer:   protocol.NewWriter(conn, manager.config.Framing, manager.config.MaxFrameSize),
+		data:     make(chan []byte, manager.config.QueueSize),
+		patterns: make(map[string]bool),
+
+		connectedAt:   time.Now(),
+		messageBucket: newTokenBucket(manager.config.RateLimits.MessageRate, manager.config.RateLimits.MessageBurst),
+		byteBucket:    newTokenBucket(manager.config.RateLimits.ByteRate, manager.config.RateLimits.ByteBurst),
+	}
+}
+
+// newLink is newClient for a federation link to the peer server link, with the rate limits of links.
+func (manager *ClientManager) newLink(conn net.Conn, identity protocol.Identity, link string) *Client {
+	client := manager.newClient(conn, identity)
+	client.link = link
+	client.messageBucket = newTokenBucket(manager.config.LinkRateLimits.MessageRate, manager.config.LinkRateLimits.MessageBurst)
+	client.byteBucket = newTokenBucket(manager.config.LinkRateLimits.ByteRate, manager.config.LinkRateLimits.ByteBurst)
+	return client
+}
+
+func (manager *ClientManager) start() {
+	var compactCh <-chan time.Time
+	if manager.config.MessageLog != nil && manager.config.CompactInterval > 0 {
+		ticker := time.NewTicker(manager.config.CompactInterval)
+		defer ticker.Stop()
+		compactCh = ticker.C
+	}
+	var pingCh <-chan time.Time
+	if manager.config.PingInterval > 0 {
+		ticker := time.NewTicker(manager.config.PingInterval)
+		defer ticker.Stop()
+		pingCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-compactCh:
+			manager.compact()
+		case now := <-pingCh:
+			ping := &protocol.Message{Kind: protocol.KindPing, Time: now, Body: strconv.FormatInt(now.UnixNano(), 10)}
+			for client := range manager.clients {
+				manager.deliver(client, ping)
+			}
+		case client := <-manager.registerCh:
+			manager.clients[client] = true
+			atomic.AddUint64(&manager.metrics.connections, 1)
+			if client.link != "" {
+				fmt.Println("[LINKED]: Peer linked: " + client.link + " (" + client.identity.Addr + ")")
+				break
+			}
+			manager.join(client)
+			manager.subscribe(client, protocol.DefaultTopic)
+			manager.replayRecent(client, manager.config.HistoryReplay)
+			fmt.Println("[REGISTERED]: Client registered: " + describe(client.identity))
+		case client := <-manager.unregisterCh:
+			if _, ok := manager.clients[client]; ok {
+				manager.remove(client)
+			}
+		case subscription := <-manager.subscribeCh:
+			if _, ok := manager.clients[subscription.client]; ok {
+				manager.subscribe(subscription.client, subscription.pattern)
+				manager.deliver(subscription.client, notice("subscribed to "+subscription.pattern))
+			}
+		case subscription := <-manager.unsubscribeCh:
+			if _, ok := manager.clients[subscription.client]; ok {
+				if manager.unsubscribe(subscription.client, subscription.pattern) {
+					manager.deliver(subscription.client, notice("unsubscribed from "+subscription.pattern))
+				} else {
+					manager.deliver(subscription.client, notice("not subscribed to "+subscription.pattern))
+				}
+			}
+		case change := <-manager.nickCh:
+			if _, ok := manager.clients[change.client]; ok {
+				manager.changeNick(change.client, change.nick)
+			}
+		case client := <-manager.whoCh:
+			if _, ok := manager.clients[client]; ok {
+				manager.deliver(client, notice(manager.who()))
+			}
+		case request := <-manager.historyCh:
+			if _, ok := manager.clients[request.client]; ok {
+				manager.replaySince(request.client, request.since)
+			}
+		case reply := <-manager.replyCh:
+			if _, ok := manager.clients[reply.client]; ok {
+				manager.deliver(reply.client, reply.message)
+			}
+		case publication := <-manager.broadcastCh:
+			if _, ok := manager.clients[publication.client]; ok {
+				manager.broadcast(publication)
+			}
+		case result := <-manager.clientsCh:
+			result <- manager.clientInfos()
+		case kick := <-manager.kickCh:
+			kick.kicked <- manager.kick(kick)
+		case deadline := <-manager.shutdownCh:
+			manager.shutdown(deadline)
+			return
+		}
+	}
+}
+
+// Shutdown tells every client the server is going away and stops the manager,
+// the queued messages are still sent until the deadline.
+func (manager *ClientManager) Shutdown(deadline time.Time) {
+	select {
+	case manager.shutdownCh <- deadline:
+	case <-manager.done:
+	}
+	<-manager.done
+}
+
+func (manager *ClientManager) shutdown(deadline time.Time) {
+	for client := range manager.clients {
+		manager.deliver(client, notice("server is shutting down"))
+	}
+	manager.shutdownDeadline = deadline
+	for client := range manager.clients {
+		// the send goroutine gives up writing at the deadline, and closes the socket either way
+		client.socket.SetWriteDeadline(deadline)
+		close(client.data)
+		delete(manager.clients, client)
+		manager.metrics.observeConnection(time.Since(client.connectedAt))
+	}
+	close(manager.done)
+	fmt.Println("[SHUTDOWN]: Client manager stopped")
+}
+
+func (manager *ClientManager) broadcast(publication *Publication) {
+	message := publication.message
+	if publication.client.link != "" {
+		if !manager.acceptRelayed(publication.client, message) {
+			return
+		}
+	} else {
+		identity := publication.client.identity
+		message.From = &identity
+		message.Time = time.Now()
+	}
+
+	if message.Kind == protocol.KindDirect {
+		manager.direct(publication.client, message)
+		return
+	}
+	if message.Kind == protocol.KindFile {
+		manager.transfer(publication.client, message)
+		return
+	}
+
+	message.Seq = manager.seq + 1
+	if message.Origin == "" && manager.config.ServerID != "" {
+		message.Origin = manager.config.ServerID
+		message.OriginSeq = message.Seq
+	}
+	frame, err := message.Marshal()
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "encode message error"))
+		return
+	}
+	// a message is only sent out once it's safely logged
+	if err := manager.persist(frame); err != nil {
+		fmt.Println(errors.Wrap(err, "log message error"))
+		manager.deliver(publication.client, notice("message not sent: "+err.Error()))
+		return
+	}
+	manager.seq = message.Seq
+	manager.history.Add(message)
+
+	fmt.Println("[BROADCASTING]: #" + message.Topic + " " + message.From.String() + ": " + message.Body)
+	for client := range manager.subscribers(message.Topic) {
+		manager.deliverFrame(client, frame)
+	}
+	manager.relay(publication.client, message, frame)
+}
+
+func (manager *ClientManager) subscribe(client *Client, pattern string) {
+	members, ok := manager.subscriptions[pattern]
+	if !ok {
+		members = make(map[*Client]bool)
+		manager.subscriptions[pattern] = members
+	}
+	members[client] = true
+	client.patterns[pattern] = true
+}
+
+func (manager *ClientManager) unsubscribe(client *Client, pattern string) bool {
+	if !client.patterns[pattern] {
+		return false
+	}
+	delete(client.patterns, pattern)
+	delete(manager.subscriptions[pattern], client)
+	if len(manager.subscriptions[pattern]) == 0 {
+		delete(manager.subscriptions, pattern)
+	}
+	return true
+}
+
+// subscribers collects the clients subscribed to a topic, directly or by wildcard,
+// a client matching more than one pattern only counts once.
+func (manager *ClientManager) subscribers(topic string) map[*Client]bool {
+	subscribers := make(map[*Client]bool)
+	for client := range manager.subscriptions[topic] {
+		subscribers[client] = true
+	}
+	for pattern, members := range manager.subscriptions {
+		if !protocol.IsWildcard(pattern) || !protocol.MatchTopic(pattern, topic) {
+			continue
+		}
+		for client := range members {
+			subscribers[client] = true
+		}
+	}
+	return subscribers
+}
+
+// remove drops a client and tells the others it left,
+// it's a no-op for a client that's already gone so data is never closed twice.
+func (manager *ClientManager) remove(client *Client) {
+	if _, ok := manager.clients[client]; !ok {
+		return
+	}
+	delete(manager.clients, client)
+	manager.metrics.observeConnection(time.Since(client.connectedAt))
+	for pattern := range client.patterns {
+		manager.unsubscribe(client, pattern)
+	}
+	close(client.data)
+	if client.link != "" {
+		fmt.Println("[UNLINKED]: Peer unlinked: " + client.link + " (" + client.identity.Addr + ")")
+		return
+	}
+	manager.leave(client)
+	fmt.Println("[UNREGISTERED]: Client unregistered: " + describe(client.identity))
+}
+
+func (manager *ClientManager) deliver(client *Client, message *protocol.Message) {
+	if message.Time.IsZero() {
+		message.Time = time.Now()
+	}
+	frame, err := message.Marshal()
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "encode message error"))
+		return
+	}
+	manager.deliverFrame(client, frame)
+}
+
+func (manager *ClientManager) receive(client *Client) {
+	defer func() {
+		select {
+		case manager.unregisterCh <- client:
+		case <-manager.done:
+		}
+		client.socket.Close()
+	}()
+
+	for {
+		if manager.config.IdleTimeout > 0 {
+			client.socket.SetReadDeadline(time.Now().Add(manager.config.IdleTimeout))
+		}
+		frame, err := client.reader.ReadFrame()
+		if err != nil {
+			if netErr, ok := errors.Cause(err).(net.Error); ok && netErr.Timeout() {
+				fmt.Println("[TIMEOUT]: Client idle for " + manager.config.IdleTimeout.String())
+				client.quitReason = "ping timeout"
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Println(errors.Wrap(err, "read frame error"))
+			}
+			return
+		}
+		manager.metrics.received(frame)
+		if ok, quit := manager.limit(client, frame); quit {
+			return
+		} else if !ok {
+			continue
+		}
+		if client.link != "" {
+			manager.receiveRelayed(client, frame)
+			continue
+		}
+		text := string(frame)
+		command, isCommand := protocol.ParseCommand(text)
+		if !isCommand || command.Name != protocol.CommandPong && command.Name != protocol.CommandFile {
+			fmt.Println("[RECEIVED]: " + text)
+		}
+		if isCommand {
+			if quit := manager.handleCommand(client, command); quit {
+				return
+			}
+			continue
+		}
+		manager.publish(client, &protocol.Message{
+			Kind:  protocol.KindMessage,
+			Topic: protocol.DefaultTopic,
+			Body:  protocol.UnescapeMessage(text),
+		})
+	}
+}
+
+func (manager *ClientManager) publish(client *Client, message *protocol.Message) {
+	select {
+	case manager.broadcastCh <- &Publication{client: client, message: message}:
+	case <-manager.done:
+	}
+}
+
+func (manager *ClientManager) reply(client *Client, message *protocol.Message) {
+	select {
+	case manager.replyCh <- &Reply{client: client, message: message}:
+	case <-manager.done:
+	}
+}
+
+// register returns false if the manager has shut down.
+func (manager *ClientManager) register(client *Client) bool {
+	select {
+	case manager.registerCh <- client:
+		return true
+	case <-manager.done:
+		return false
+	}
+}
+
+func (manager *ClientManager) send(client *Client) {
+	defer client.socket.Close()
+	for {
+		select {
+		case message, ok := <-client.data:
+			if !ok {
+				return
+			}
+			if deadline, ok := manager.writeDeadline(); ok {
+				client.socket.SetWriteDeadline(deadline)
+			}
+			if err := client.writer.WriteFrame(message); err != nil {
+				fmt.Println(errors.Wrap(err, "write frame error"))
+				return
+			}
+			manager.metrics.sent(message)
+		}
+	}
+}
+
+// writeDeadline is when the next write must be done by, it's never later than the shutdown deadline.
+func (manager *ClientManager) writeDeadline() (time.Time, bool) {
+	var deadline time.Time
+	if manager.config.WriteTimeout > 0 {
+		deadline = time.Now().Add(manager.config.WriteTimeout)
+	}
+	select {
+	case <-manager.done:
+		if deadline.IsZero() || manager.shutdownDeadline.Before(deadline) {
+			deadline = manager.shutdownDeadline
+		}
+	default:
+	}
+	return deadline, !deadline.IsZero()
+}
+
+func notice(body string) *protocol.Message {
+	return &protocol.Message{Kind: protocol.KindNotice, Body: body}
+}
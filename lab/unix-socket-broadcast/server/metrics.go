@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the connection duration histogram.
+var durationBuckets = []float64{1, 10, 60, 300, 1800, 3600, 6 * 3600, 24 * 3600}
+
+// Metrics counts what goes through the server, the counters are accessed atomically
+// from the receive and send goroutines.
+type Metrics struct {
+	connections      uint64
+	messagesReceived uint64
+	bytesReceived    uint64
+	messagesSent     uint64
+	bytesSent        uint64
+	dropped          uint64
+	kicked           uint64
+
+	mu sync.Mutex
+	// durations is the histogram of connection durations, one count per bucket and the +Inf one
+	durations     []uint64
+	durationSum   float64
+	durationCount uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{durations: make([]uint64, len(durationBuckets)+1)}
+}
+
+func (metrics *Metrics) received(frame []byte) {
+	atomic.AddUint64(&metrics.messagesReceived, 1)
+	atomic.AddUint64(&metrics.bytesReceived, uint64(len(frame)))
+}
+
+func (metrics *Metrics) sent(frame []byte) {
+	atomic.AddUint64(&metrics.messagesSent, 1)
+	atomic.AddUint64(&metrics.bytesSent, uint64(len(frame)))
+}
+
+func (metrics *Metrics) observeConnection(duration time.Duration) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(durationBuckets, seconds)
+	metrics.durations[i]++
+	metrics.durationSum += seconds
+	metrics.durationCount++
+}
+
+// ClientInfo describes a connected client for the admin endpoint.
+type ClientInfo struct {
+	Nick        string    `json:"nick,omitempty"`
+	Addr        string    `json:"addr,omitempty"`
+	CommonName  string    `json:"cn,omitempty"`
+	Cred        string    `json:"cred,omitempty"`
+	Link        string    `json:"link,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Patterns    []string  `json:"patterns,omitempty"`
+	Queued      int       `json:"queued"`
+	Dropped     uint64    `json:"dropped"`
+	Limited     uint64    `json:"limited"`
+}
+
+// clientInfos lists the clients, it runs in the manager goroutine.
+func (manager *ClientManager) clientInfos() []ClientInfo {
+	infos := make([]ClientInfo, 0, len(manager.clients))
+	for client := range manager.clients {
+		info := ClientInfo{
+			Nick:        client.identity.Nick,
+			Addr:        client.identity.Addr,
+			CommonName:  client.identity.CommonName,
+			Link:        client.link,
+			ConnectedAt: client.connectedAt,
+			Queued:      len(client.data),
+			Dropped:     client.Dropped(),
+			Limited:     client.Limited(),
+		}
+		if client.identity.Cred != nil {
+			info.Cred = client.identity.Cred.String()
+		}
+		for pattern := range client.patterns {
+			info.Patterns = append(info.Patterns, pattern)
+		}
+		sort.Strings(info.Patterns)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// writeMetrics writes the metrics in the Prometheus text format.
+func (manager *ClientManager) writeMetrics(w io.Writer, clients []ClientInfo) {
+	metrics := manager.metrics
+	var connected, links, queued, maxQueued int
+	for _, client := range clients {
+		if client.Link != "" {
+			links++
+		} else {
+			connected++
+		}
+		queued += client.Queued
+		if client.Queued > maxQueued {
+			maxQueued = client.Queued
+		}
+	}
+	guard := manager.guard.Stats()
+
+	gauge := func(name, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+
+	gauge("broadcast_clients_connected", "Number of connected clients.", connected)
+	gauge("broadcast_links_connected", "Number of connected federation links.", links)
+	gauge("broadcast_queue_depth", "Outgoing messages queued for all clients.", queued)
+	gauge("broadcast_queue_depth_max", "Outgoing messages queued for the most behind client.", maxQueued)
+	gauge("broadcast_bans_active", "Number of peers currently banned.", guard.ActiveBans)
+	counter("broadcast_connections_total", "Clients registered since the server started.", atomic.LoadUint64(&metrics.connections))
+	counter("broadcast_connections_rejected_total", "Connections refused by the connection limits or a ban.", guard.Rejected)
+	counter("broadcast_kicked_total", "Clients kicked by an admin.", atomic.LoadUint64(&metrics.kicked))
+	counter("broadcast_messages_received_total", "Frames received from clients.", atomic.LoadUint64(&metrics.messagesReceived))
+	counter("broadcast_bytes_received_total", "Bytes of frames received from clients.", atomic.LoadUint64(&metrics.bytesReceived))
+	counter("broadcast_messages_sent_total", "Frames sent to clients.", atomic.LoadUint64(&metrics.messagesSent))
+	counter("broadcast_bytes_sent_total", "Bytes of frames sent to clients.", atomic.LoadUint64(&metrics.bytesSent))
+	counter("broadcast_messages_dropped_total", "Messages dropped because a client was too slow.", atomic.LoadUint64(&metrics.dropped))
+	counter("broadcast_rate_limited_total", "Frames over the rate limits of their client.", guard.Limited)
+	counter("broadcast_bans_total", "Peers banned for flooding.", guard.Banned)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	name := "broadcast_connection_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s How long clients stayed connected.\n# TYPE %s histogram\n", name, name)
+	var cumulative uint64
+	for i, bound := range durationBuckets {
+		cumulative += metrics.durations[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	cumulative += metrics.durations[len(durationBuckets)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, metrics.durationSum, name, metrics.durationCount)
+}
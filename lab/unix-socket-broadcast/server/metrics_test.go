@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestConnectionDurationOnShutdown(t *testing.T) {
+	manager := newTestManager(t, ManagerConfig{})
+	for _, name := range []string{"alice", "bob"} {
+		_, peer := connectPipe(t, manager, name)
+		go io.Copy(io.Discard, peer)
+	}
+	clientInfos(manager)
+
+	manager.Shutdown(time.Now().Add(time.Second))
+	manager.metrics.mu.Lock()
+	defer manager.metrics.mu.Unlock()
+	if manager.metrics.durationCount != 2 {
+		t.Fatalf("expected the connections still open at shutdown to be observed, got %d", manager.metrics.durationCount)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"strconv"
+	"strings"
+)
+
+var errNotUnixSocket = errors.New("peer credentials are only available on unix sockets")
+
+// PeerAllowlist admits a client if its UID or its GID is listed,
+// an empty allowlist admits everybody.
+type PeerAllowlist struct {
+	uids map[uint32]bool
+	gids map[uint32]bool
+}
+
+func NewPeerAllowlist(uids, gids []uint32) *PeerAllowlist {
+	allowlist := &PeerAllowlist{
+		uids: make(map[uint32]bool),
+		gids: make(map[uint32]bool),
+	}
+	for _, uid := range uids {
+		allowlist.uids[uid] = true
+	}
+	for _, gid := range gids {
+		allowlist.gids[gid] = true
+	}
+	return allowlist
+}
+
+func (allowlist *PeerAllowlist) Empty() bool {
+	return len(allowlist.uids) == 0 && len(allowlist.gids) == 0
+}
+
+func (allowlist *PeerAllowlist) Allowed(cred *protocol.Credentials) bool {
+	if allowlist.Empty() {
+		return true
+	}
+	if cred == nil {
+		return false
+	}
+	return allowlist.uids[cred.UID] || allowlist.gids[cred.GID]
+}
+
+// parseIDs parses a comma-separated list of numeric ids, like "1000,1001".
+func parseIDs(s string) ([]uint32, error) {
+	var ids []uint32
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid id %q", field)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"net"
+	"syscall"
+)
+
+func peerCredentials(conn net.Conn) (*protocol.Credentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errNotUnixSocket
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "get raw connection error")
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "control raw connection error")
+	}
+	if credErr != nil {
+		return nil, errors.Wrap(credErr, "getsockopt SO_PEERCRED error")
+	}
+
+	return &protocol.Credentials{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid}, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"net"
+)
+
+func peerCredentials(conn net.Conn) (*protocol.Credentials, error) {
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return nil, errNotUnixSocket
+	}
+	return nil, errors.New("SO_PEERCRED is only supported on linux")
+}
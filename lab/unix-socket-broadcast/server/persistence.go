@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"sync/atomic"
+)
+
+// restore rebuilds the history and the sequence number from the message log,
+// it must be called before the manager starts.
+func (manager *ClientManager) restore() error {
+	if manager.config.MessageLog == nil {
+		return nil
+	}
+	count, skipped := 0, 0
+	// corrupted segments are skipped by the log itself, a message that doesn't decode is skipped here
+	err := manager.config.MessageLog.Replay(func(data []byte) error {
+		message, err := protocol.UnmarshalMessage(data)
+		if err != nil {
+			skipped++
+			return nil
+		}
+		// an interrupted compaction may leave a message twice
+		if message.Seq <= manager.seq {
+			return nil
+		}
+		manager.seq = message.Seq
+		manager.history.Add(message)
+		count++
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "replay message log error")
+	}
+	if skipped > 0 {
+		fmt.Printf("[RESTORED]: Skipped %d messages that don't decode\n", skipped)
+	}
+	fmt.Printf("[RESTORED]: %d messages, last seq %d\n", count, manager.seq)
+	return nil
+}
+
+// persist appends an encoded message to the message log, if there is one.
+func (manager *ClientManager) persist(frame []byte) error {
+	if manager.config.MessageLog == nil {
+		return nil
+	}
+	return manager.config.MessageLog.Append(frame)
+}
+
+// compact drops the logged messages that fell out of the history, then applies the retention limits.
+// What to keep is decided in the manager goroutine, which owns the history, the segments are
+// rewritten in the background so publishing goes on. A compaction still running is let be.
+func (manager *ClientManager) compact() {
+	if manager.config.MessageLog == nil || !atomic.CompareAndSwapInt32(&manager.compacting, 0, 1) {
+		return
+	}
+	kept := make(map[uint64]bool)
+	for _, r := range manager.history.topics {
+		for _, message := range r.ordered() {
+			kept[message.Seq] = true
+		}
+	}
+	// the log picks the segments to rewrite later, what's published meanwhile may be in them
+	lastSeq := manager.seq
+	go func() {
+		defer atomic.StoreInt32(&manager.compacting, 0)
+		err := manager.config.MessageLog.Compact(func(data []byte) bool {
+			message, err := protocol.UnmarshalMessage(data)
+			return err == nil && (message.Seq > lastSeq || kept[message.Seq])
+		})
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "compact message log error"))
+		}
+		if err := manager.config.MessageLog.ApplyRetention(); err != nil {
+			fmt.Println(errors.Wrap(err, "apply message log retention error"))
+		}
+	}()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/wal"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompactKeepsMessagesAfterSnapshot(t *testing.T) {
+	messageLog, err := wal.Open(wal.Options{Dir: t.TempDir(), SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer messageLog.Close()
+	manager := NewClientManager(ManagerConfig{HistorySize: 2, MessageLog: messageLog})
+
+	for seq := uint64(1); seq <= 10; seq++ {
+		message := &protocol.Message{Kind: protocol.KindMessage, Seq: seq, Time: time.Now(), Topic: protocol.DefaultTopic, Body: "message"}
+		frame, err := message.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := messageLog.Append(frame); err != nil {
+			t.Fatal(err)
+		}
+		// the history is snapshot at 5, the rest is published while the segments are rewritten
+		if seq <= 5 {
+			manager.history.Add(message)
+			manager.seq = seq
+		}
+	}
+	manager.compact()
+	for atomic.LoadInt32(&manager.compacting) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var seqs []uint64
+	if err := messageLog.Replay(func(data []byte) error {
+		message, err := protocol.UnmarshalMessage(data)
+		if err != nil {
+			return err
+		}
+		seqs = append(seqs, message.Seq)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 7 || seqs[0] != 4 || seqs[6] != 10 {
+		t.Fatalf("expected seqs 4 to 10, got %v", seqs)
+	}
+}
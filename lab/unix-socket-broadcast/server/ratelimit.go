@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitAction decides what happens to a client sending faster than its rate limits.
+type RateLimitAction string
+
+const (
+	// ActionThrottle stops reading from the client until it's within its limits again.
+	ActionThrottle RateLimitAction = "throttle"
+	// ActionDrop discards what the client sends over its limits.
+	ActionDrop RateLimitAction = "drop"
+	// ActionDisconnect kicks the client.
+	ActionDisconnect RateLimitAction = "disconnect"
+	// ActionBan kicks the client and refuses its peer for a while.
+	ActionBan RateLimitAction = "ban"
+)
+
+func ParseRateLimitAction(s string) (RateLimitAction, error) {
+	switch action := RateLimitAction(s); action {
+	case ActionThrottle, ActionDrop, ActionDisconnect, ActionBan:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown rate limit action: %s", s)
+}
+
+type RateLimits struct {
+	// MessageRate is how many frames a client can send per second, 0 means no limit
+	MessageRate float64
+	// MessageBurst is how many frames a client can send at once, at least 1 if there is a MessageRate
+	MessageBurst int
+	// ByteRate is how many bytes a client can send per second, 0 means no limit
+	ByteRate float64
+	// ByteBurst is how many bytes a client can send at once, at least 1 if there is a ByteRate
+	ByteBurst int
+	Action    RateLimitAction
+}
+
+// Validate refuses bursts that would let nothing through.
+func (limits RateLimits) Validate() error {
+	if limits.MessageRate > 0 && limits.MessageBurst < 1 {
+		return errors.New("message burst must be at least 1")
+	}
+	if limits.ByteRate > 0 && limits.ByteBurst < 1 {
+		return errors.New("byte burst must be at least 1")
+	}
+	return nil
+}
+
+// tokenBucket allows rate tokens per second, up to burst at once. A nil bucket allows everything.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+}
+
+// allow takes n tokens if there are enough, a full bucket is enough for anything larger than burst.
+func (bucket *tokenBucket) allow(n float64, now time.Time) bool {
+	if bucket == nil {
+		return true
+	}
+	bucket.refill(now)
+	needed := n
+	if needed > bucket.burst {
+		needed = bucket.burst
+	}
+	if bucket.tokens < needed {
+		return false
+	}
+	bucket.tokens -= n
+	return true
+}
+
+func (bucket *tokenBucket) refund(n float64) {
+	if bucket != nil {
+		bucket.tokens += n
+	}
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long until the debt is paid.
+func (bucket *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if bucket == nil {
+		return 0
+	}
+	bucket.refill(now)
+	bucket.tokens -= n
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// limit applies the rate limits to a frame from the client, it returns false if the frame
+// must be discarded, and sets quit if the client must be disconnected.
+// It runs in the receive goroutine of the client, which owns the buckets.
+func (manager *ClientManager) limit(client *Client, frame []byte) (ok bool, quit bool) {
+	limits := manager.config.RateLimits
+	if client.link != "" {
+		limits = manager.config.LinkRateLimits
+	}
+	now := time.Now()
+	size := float64(len(frame))
+	if limits.Action == ActionThrottle {
+		wait := client.messageBucket.reserve(1, now)
+		if byteWait := client.byteBucket.reserve(size, now); byteWait > wait {
+			wait = byteWait
+		}
+		if wait > 0 {
+			manager.countLimited(client)
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-manager.done:
+			}
+		}
+		return true, false
+	}
+
+	// both buckets are checked so a message over the byte limit doesn't cost a message token
+	if client.messageBucket.allow(1, now) {
+		if client.byteBucket.allow(size, now) {
+			client.limitNoticed = false
+			return true, false
+		}
+		client.messageBucket.refund(1)
+	}
+	manager.countLimited(client)
+
+	switch limits.Action {
+	case ActionDrop:
+		// one notice per burst of dropped messages, not to flood the client with them
+		if !client.limitNoticed {
+			client.limitNoticed = true
+			manager.reply(client, notice("rate limit exceeded, messages dropped"))
+		}
+		return false, false
+	case ActionBan:
+		manager.guard.Ban(peerKey(client.identity))
+		fmt.Println("[BANNED]: Client banned for " + manager.guard.banDuration.String() + ": " + describe(client.identity))
+		client.quitReason = "banned for flooding"
+	default:
+		fmt.Println("[LIMITED]: Client disconnected for flooding: " + describe(client.identity))
+		client.quitReason = "rate limit exceeded"
+	}
+	return false, true
+}
+
+func (manager *ClientManager) countLimited(client *Client) {
+	if atomic.AddUint64(&client.limited, 1) == 1 {
+		fmt.Println("[LIMITED]: Client over its rate limits: " + describe(client.identity))
+	}
+	atomic.AddUint64(&manager.guard.limited, 1)
+}
+
+func (client *Client) Limited() uint64 {
+	return atomic.LoadUint64(&client.limited)
+}
+
+var (
+	ErrTooManyClients = errors.New("too many clients")
+	ErrTooManyForPeer = errors.New("too many connections from the same peer")
+	ErrBanned         = errors.New("banned")
+)
+
+// Guard limits the number of clients, in total and from the same peer, and keeps the bans.
+type Guard struct {
+	maxClients  int
+	maxPerPeer  int
+	banDuration time.Duration
+
+	mu      sync.Mutex
+	clients int
+	peers   map[string]int
+	bans    map[string]time.Time
+
+	// counters, accessed atomically
+	limited  uint64
+	rejected uint64
+	banned   uint64
+}
+
+// NewGuard creates a guard, a limit of 0 means no limit.
+func NewGuard(maxClients, maxPerPeer int, banDuration time.Duration) *Guard {
+	return &Guard{
+		maxClients:  maxClients,
+		maxPerPeer:  maxPerPeer,
+		banDuration: banDuration,
+		peers:       make(map[string]int),
+		bans:        make(map[string]time.Time),
+	}
+}
+
+// Admit counts a new connection from peer, Release must be called once it's gone.
+func (guard *Guard) Admit(peer string) error {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	err := guard.admit(peer)
+	if err != nil {
+		atomic.AddUint64(&guard.rejected, 1)
+		return err
+	}
+	guard.clients++
+	guard.peers[peer]++
+	return nil
+}
+
+func (guard *Guard) admit(peer string) error {
+	if until, ok := guard.bans[peer]; ok {
+		if time.Now().Before(until) {
+			return ErrBanned
+		}
+		delete(guard.bans, peer)
+	}
+	if guard.maxClients > 0 && guard.clients >= guard.maxClients {
+		return ErrTooManyClients
+	}
+	if guard.maxPerPeer > 0 && guard.peers[peer] >= guard.maxPerPeer {
+		return ErrTooManyForPeer
+	}
+	return nil
+}
+
+func (guard *Guard) Release(peer string) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	guard.clients--
+	guard.peers[peer]--
+	if guard.peers[peer] <= 0 {
+		delete(guard.peers, peer)
+	}
+}
+
+func (guard *Guard) Ban(peer string) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	guard.bans[peer] = time.Now().Add(guard.banDuration)
+	atomic.AddUint64(&guard.banned, 1)
+}
+
+// GuardStats are the counters of a guard since the server started.
+type GuardStats struct {
+	// Limited counts frames over the rate limits, throttled, dropped or the reason of a disconnection
+	Limited  uint64
+	Rejected uint64
+	Banned   uint64
+	// ActiveBans is how many peers are currently banned
+	ActiveBans int
+}
+
+func (guard *Guard) Stats() GuardStats {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	now := time.Now()
+	active := 0
+	for _, until := range guard.bans {
+		if now.Before(until) {
+			active++
+		}
+	}
+	return GuardStats{
+		Limited:    atomic.LoadUint64(&guard.limited),
+		Rejected:   atomic.LoadUint64(&guard.rejected),
+		Banned:     atomic.LoadUint64(&guard.banned),
+		ActiveBans: active,
+	}
+}
+
+// peerKey is what connection limits and bans apply to: the user of a unix socket peer,
+// or the IP address of a network peer.
+func peerKey(identity protocol.Identity) string {
+	if identity.Cred != nil {
+		return "uid=" + strconv.FormatUint(uint64(identity.Cred.UID), 10)
+	}
+	if host, _, err := net.SplitHostPort(identity.Addr); err == nil {
+		return host
+	}
+	return identity.Addr
+}
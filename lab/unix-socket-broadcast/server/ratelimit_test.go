@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitsValidate(t *testing.T) {
+	for _, limits := range []RateLimits{
+		{MessageRate: 10, MessageBurst: 0},
+		{ByteRate: 1024, ByteBurst: -1},
+	} {
+		if limits.Validate() == nil {
+			t.Fatalf("expected %+v to be refused", limits)
+		}
+	}
+	for _, limits := range []RateLimits{
+		{},
+		{MessageRate: 10, MessageBurst: 1, ByteRate: 1024, ByteBurst: 1},
+	} {
+		if err := limits.Validate(); err != nil {
+			t.Fatalf("expected %+v to be valid, got %v", limits, err)
+		}
+	}
+}
+
+// a burst below the rate is kept as it is.
+func TestTokenBucketBurst(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(100, 2)
+	bucket.last = now
+	for i := 0; i < 2; i++ {
+		if !bucket.allow(1, now) {
+			t.Fatalf("expected token %d to be allowed", i)
+		}
+	}
+	if bucket.allow(1, now) {
+		t.Fatal("expected the burst to be used up")
+	}
+	if !bucket.allow(1, now.Add(10*time.Millisecond)) {
+		t.Fatal("expected a token after 10ms at 100 per second")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/tlsconfig"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout is how long a client gets to finish the TLS handshake.
+const handshakeTimeout = 10 * time.Second
+
+type Server struct {
+	listener  net.Listener
+	manager   *ClientManager
+	allowlist *PeerAllowlist
+	// TLSConfig enables TLS if it's not nil, a verified client certificate is part of the client identity
+	TLSConfig *tls.Config
+	// FederationListener accepts links from peer servers if it's not nil, over TLS if TLSConfig is set
+	FederationListener net.Listener
+	// FederationAllow are the networks peer servers can link from, if it's empty
+	// they have to present a certificate verified by TLSConfig
+	FederationAllow []*net.IPNet
+	// FederationPeers are the IDs of the peer servers that can link with a certificate,
+	// whose common name has to be their ID
+	FederationPeers map[string]bool
+	// Peers are the addresses of the federation listeners of the servers to link to
+	Peers []string
+	// LinkTLSConfig links to the peers over TLS if it's not nil
+	LinkTLSConfig *tls.Config
+	// AdminListener serves the metrics and the admin operations over HTTP if it's not nil
+	AdminListener net.Listener
+	// AdminToken has to be sent as a bearer token to kick clients if it's not empty
+	AdminToken string
+	// GatewayListener serves the WebSocket gateway and its chat page over HTTP if it's not nil
+	GatewayListener net.Listener
+	// ShutdownTimeout is how long clients get to receive their queued messages when shutting down
+	ShutdownTimeout time.Duration
+	// connections tracks the receive and send goroutines of every client
+	connections sync.WaitGroup
+	// closed is set once connections are being waited for, no more can be tracked
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewServer(listener net.Listener, manager *ClientManager, allowlist *PeerAllowlist) *Server {
+	return &Server{
+		listener:        listener,
+		manager:         manager,
+		allowlist:       allowlist,
+		ShutdownTimeout: 5 * time.Second,
+	}
+}
+
+// Serve accepts clients until ctx is done, then it stops accepting, tells the clients,
+// gives them until ShutdownTimeout to receive what's queued for them, and closes everything.
+// It returns nil after a shutdown caused by ctx.
+func (server *Server) Serve(ctx context.Context) error {
+	go server.manager.start()
+	// it stops the federation too if accepting clients fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var gateway *http.Server
+	if server.GatewayListener != nil {
+		gateway = &http.Server{Handler: server.gateway(), TLSConfig: server.TLSConfig}
+		go func() {
+			var err error
+			if server.TLSConfig != nil {
+				err = gateway.ServeTLS(server.GatewayListener, "", "")
+			} else {
+				err = gateway.Serve(server.GatewayListener)
+			}
+			if err != http.ErrServerClosed {
+				fmt.Println(errors.Wrap(err, "serve gateway error"))
+			}
+		}()
+		fmt.Println("[WAITING]: Gateway listening on " + server.GatewayListener.Addr().String())
+	}
+
+	var admin *http.Server
+	if server.AdminListener != nil {
+		admin = &http.Server{Handler: server.admin()}
+		go func() {
+			if err := admin.Serve(server.AdminListener); err != http.ErrServerClosed {
+				fmt.Println(errors.Wrap(err, "serve admin error"))
+			}
+		}()
+		fmt.Println("[WAITING]: Admin listening on " + server.AdminListener.Addr().String())
+	}
+
+	if server.FederationListener != nil {
+		server.connections.Add(1)
+		go func() {
+			defer server.connections.Done()
+			if err := server.accept(ctx, server.FederationListener, server.handleLink); err != nil {
+				fmt.Println(err)
+			}
+		}()
+		fmt.Println("[WAITING]: Federation listening on " + server.FederationListener.Addr().String())
+	}
+	for _, peer := range server.Peers {
+		server.connections.Add(1)
+		go func(peer string) {
+			defer server.connections.Done()
+			server.linkPeer(ctx, peer)
+		}(peer)
+	}
+
+	fmt.Println("[WAITING]")
+	serveErr := server.accept(ctx, server.listener, server.handle)
+
+	fmt.Println("[SHUTDOWN]: Server shutting down...")
+	cancel()
+	if gateway != nil {
+		// it doesn't close the WebSockets, they are taken over from it, the manager shuts them down
+		gateway.Close()
+	}
+	if admin != nil {
+		admin.Close()
+	}
+	server.manager.Shutdown(time.Now().Add(server.ShutdownTimeout))
+	server.mu.Lock()
+	server.closed = true
+	server.mu.Unlock()
+	server.connections.Wait()
+	fmt.Println("[SHUTDOWN]: Server stopped")
+	return serveErr
+}
+
+// accept runs handle for every connection until ctx is done, it closes the listener.
+func (server *Server) accept(ctx context.Context, listener net.Listener, handle func(conn net.Conn)) error {
+	return socketserver.Accept(ctx, listener, func(conn net.Conn) {
+		// handshakes take a few round trips, they are not done in the accept loop
+		server.connections.Add(1)
+		go func() {
+			defer server.connections.Done()
+			handle(conn)
+		}()
+	})
+}
+
+func (server *Server) handle(conn net.Conn) {
+	identity := protocol.Identity{Addr: conn.RemoteAddr().String()}
+	cred, err := peerCredentials(conn)
+	if err != nil && err != errNotUnixSocket {
+		fmt.Println(errors.Wrap(err, "get peer credentials error"))
+	}
+	identity.Cred = cred
+	if !server.allowlist.Allowed(cred) {
+		fmt.Println("[REJECTED]: Client not allowed: " + identity.String())
+		conn.Close()
+		return
+	}
+
+	// the limits are checked first, a refused peer doesn't get to cost a TLS handshake
+	if err := server.admit(identity); err != nil {
+		server.reject(conn, identity, err)
+		conn.Close()
+		return
+	}
+
+	if server.TLSConfig != nil {
+		tlsConn := tls.Server(conn, server.TLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			fmt.Println("[REJECTED]: TLS handshake with " + identity.String() + " failed: " + err.Error())
+			server.manager.guard.Release(peerKey(identity))
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		identity.CommonName = tlsconfig.PeerName(tlsConn)
+		conn = tlsConn
+	}
+
+	client := server.manager.newClient(conn, identity)
+	if !server.run(client, true) {
+		conn.Close()
+	}
+}
+
+// admit applies the connection limits and the bans to a client connecting from identity,
+// the guard must be released once it's gone, run does it.
+func (server *Server) admit(identity protocol.Identity) error {
+	return server.manager.guard.Admit(peerKey(identity))
+}
+
+// run registers the client and starts serving it, it returns false if the server is shutting down.
+// admitted tells if the client was admitted by the guard, federation links don't count against its limits.
+func (server *Server) run(client *Client, admitted bool) bool {
+	peer := peerKey(client.identity)
+	release := func() {
+		if admitted {
+			server.manager.guard.Release(peer)
+		}
+	}
+	server.mu.Lock()
+	if server.closed {
+		server.mu.Unlock()
+		release()
+		return false
+	}
+	server.connections.Add(2)
+	server.mu.Unlock()
+
+	if !server.manager.register(client) {
+		server.connections.Add(-2)
+		release()
+		return false
+	}
+	go func() {
+		defer server.connections.Done()
+		server.manager.receive(client)
+		release()
+	}()
+	go func() {
+		defer server.connections.Done()
+		server.manager.send(client)
+	}()
+	return true
+}
+
+// reject tells a client it's not admitted, before any handshake, so only if there is no TLS.
+func (server *Server) reject(conn net.Conn, identity protocol.Identity, err error) {
+	fmt.Println("[REJECTED]: Client refused, " + err.Error() + ": " + identity.String())
+	if server.TLSConfig != nil {
+		return
+	}
+	message := notice("connection refused: " + err.Error())
+	message.Time = time.Now()
+	frame, err := message.Marshal()
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	protocol.NewWriter(conn, server.manager.config.Framing, server.manager.config.MaxFrameSize).WriteFrame(frame)
+}
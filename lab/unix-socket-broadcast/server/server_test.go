@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/wbsnail/articles/lab/unix-socket-broadcast/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	*Server
+	address string
+	stop    context.CancelFunc
+	// stopped gets what Serve returned
+	stopped chan error
+}
+
+// startServer serves on a local port, setup can configure the server before it starts.
+func startServer(t *testing.T, config ManagerConfig, setup ...func(server *Server)) *testServer {
+	t.Helper()
+	config.Framing = protocol.FramingLine
+	if config.QueueSize == 0 {
+		config.QueueSize = 64
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testServer{
+		Server:  NewServer(listener, NewClientManager(config), NewPeerAllowlist(nil, nil)),
+		address: listener.Addr().String(),
+		stopped: make(chan error, 1),
+	}
+	server.ShutdownTimeout = time.Second
+	for _, f := range setup {
+		f(server.Server)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	server.stop = stop
+	go func() { server.stopped <- server.Serve(ctx) }()
+	t.Cleanup(func() {
+		stop()
+		<-server.stopped
+	})
+	return server
+}
+
+type testClient struct {
+	conn   net.Conn
+	reader *protocol.Reader
+	writer *protocol.Writer
+}
+
+func dialServer(t *testing.T, server *testServer) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := &testClient{
+		conn:   conn,
+		reader: protocol.NewReader(conn, protocol.FramingLine, 0),
+		writer: protocol.NewWriter(conn, protocol.FramingLine, 0),
+	}
+	client.expect(t, protocol.KindNotice, "welcome")
+	return client
+}
+
+func (client *testClient) send(t *testing.T, text string) {
+	t.Helper()
+	if err := client.writer.WriteFrame([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next reads the next message, it returns nil once the connection is closed.
+func (client *testClient) next(t *testing.T, timeout time.Duration) *protocol.Message {
+	t.Helper()
+	client.conn.SetReadDeadline(time.Now().Add(timeout))
+	frame, err := client.reader.ReadFrame()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := protocol.UnmarshalMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// expect skips messages until one of kind with body starting with prefix comes,
+// pings are answered in the meantime.
+func (client *testClient) expect(t *testing.T, kind protocol.Kind, prefix string) *protocol.Message {
+	t.Helper()
+	for {
+		message := client.next(t, 2*time.Second)
+		if message == nil {
+			t.Fatalf("connection closed waiting for %s %q", kind, prefix)
+		}
+		if message.Kind == protocol.KindPing && kind != protocol.KindPing {
+			client.send(t, "/pong "+message.Body)
+			continue
+		}
+		if message.Kind == kind && len(message.Body) >= len(prefix) && message.Body[:len(prefix)] == prefix {
+			return message
+		}
+	}
+}
+
+// expectClosed skips messages until the connection is closed.
+func (client *testClient) expectClosed(t *testing.T, timeout time.Duration) []*protocol.Message {
+	t.Helper()
+	var messages []*protocol.Message
+	deadline := time.Now().Add(timeout)
+	for {
+		message := client.next(t, time.Until(deadline))
+		if message == nil {
+			return messages
+		}
+		messages = append(messages, message)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := startServer(t, ManagerConfig{})
+	alice := dialServer(t, server)
+	bob := dialServer(t, server)
+
+	alice.send(t, "hello")
+	bob.expect(t, protocol.KindMessage, "hello")
+
+	server.stop()
+	for _, client := range []*testClient{alice, bob} {
+		messages := client.expectClosed(t, 2*time.Second)
+		if len(messages) == 0 || messages[len(messages)-1].Body != "server is shutting down" {
+			t.Fatalf("expected a shutdown notice before the connection is closed, got %v", messages)
+		}
+	}
+	select {
+	case err := <-server.stopped:
+		if err != nil {
+			t.Fatalf("expected Serve to return nil, got %v", err)
+		}
+		server.stopped <- err
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve didn't return")
+	}
+	if conn, err := net.Dial("tcp", server.address); err == nil {
+		conn.Close()
+		t.Fatal("expected the listener to be closed")
+	}
+}
+
+// a client that doesn't read still gets its connection closed at the shutdown timeout.
+func TestServerShutdownStuckClient(t *testing.T) {
+	server := startServer(t, ManagerConfig{QueueSize: 1024, OverflowPolicy: PolicyDropNewest})
+	server.ShutdownTimeout = 200 * time.Millisecond
+	stuck := dialServer(t, server)
+	sender := dialServer(t, server)
+
+	// enough to fill the socket buffers of the stuck client
+	body := make([]byte, 16*1024)
+	for i := range body {
+		body[i] = 'a'
+	}
+	for i := 0; i < 200; i++ {
+		sender.send(t, string(body))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	server.stop()
+	select {
+	case err := <-server.stopped:
+		server.stopped <- err
+	case <-time.After(3 * time.Second):
+		t.Fatal("Serve didn't return")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("shutdown took %s, expected about the shutdown timeout", elapsed)
+	}
+	stuck.expectClosed(t, 5*time.Second)
+}
+
+func TestServerHeartbeat(t *testing.T) {
+	server := startServer(t, ManagerConfig{PingInterval: 50 * time.Millisecond, IdleTimeout: 200 * time.Millisecond})
+	client := dialServer(t, server)
+	observer := dialServer(t, server)
+
+	// answering pings keeps the client connected well past the idle timeout
+	deadline := time.Now().Add(600 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		for _, c := range []*testClient{client, observer} {
+			ping := c.expect(t, protocol.KindPing, "")
+			c.send(t, "/pong "+ping.Body)
+		}
+	}
+
+	// once it stops, it's disconnected and the others are told why
+	observer.expect(t, protocol.KindLeave, "ping timeout")
+	client.expectClosed(t, time.Second)
+}
+
+// a peer over its connection limits is refused before the TLS handshake.
+func TestConnectionLimitBeforeHandshake(t *testing.T) {
+	certs, pool := testCertificates(t, "server")
+	server := startServer(t, ManagerConfig{MaxConnectionsPerPeer: 1}, func(server *Server) {
+		server.TLSConfig = &tls.Config{Certificates: certs}
+	})
+	first, err := tls.Dial("tcp", server.address, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// it never starts a handshake, it's only closed if it's refused right away
+	second, err := net.Dial("tcp", server.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the second connection to be closed before the handshake, got %v", err)
+	}
+	if rejected := server.manager.guard.Stats().Rejected; rejected != 1 {
+		t.Fatalf("expected 1 rejected connection, got %d", rejected)
+	}
+}
@@ -0,0 +1,492 @@
+// Package wal is a tiny append-only log split into segment files.
+//
+// Every record is written as a 4-byte big-endian length, a 4-byte CRC-32C of the data,
+// and the data. Segments are named after increasing ids, like 00000000000000000001.wal,
+// only the last one is appended to.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt = ".wal"
+	// compactExt is for segments being written by Compact, leftovers of a crash are removed by Open
+	compactExt = ".compact"
+	// corruptExt is for sealed segments Replay found corrupted, they are kept aside for inspection
+	corruptExt = ".corrupt"
+	headerSize = 8
+	// MaxRecordSize protects readers from allocating garbage lengths in corrupted segments.
+	MaxRecordSize = 16 * 1024 * 1024
+)
+
+var (
+	ErrCorrupt        = errors.New("corrupt record")
+	ErrRecordTooLarge = errors.New("record too large")
+	ErrClosed         = errors.New("log closed")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Options struct {
+	Dir string
+	// SegmentSize is the size in bytes a segment grows to before a new one is started
+	SegmentSize int64
+	// MaxSize is the total size in bytes of segments to keep, 0 means no limit
+	MaxSize int64
+	// MaxAge removes segments not written to for longer than this, 0 means no limit
+	MaxAge time.Duration
+	// Sync calls fsync after every append
+	Sync bool
+}
+
+type Log struct {
+	mu      sync.Mutex
+	options Options
+	// segments are ordered by id, the last one is active
+	segments []*segment
+	active   *os.File
+	closed   bool
+	// compactMu is held for the whole of a compaction, which only takes mu to start and to finish,
+	// compacting keeps retention from removing the segments being compacted in the meantime
+	compactMu  sync.Mutex
+	compacting bool
+}
+
+type segment struct {
+	id      uint64
+	size    int64
+	modTime time.Time
+}
+
+func Open(options Options) (*Log, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = 16 * 1024 * 1024
+	}
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create log dir error")
+	}
+
+	log := &Log{options: options}
+	if err := log.load(); err != nil {
+		return nil, err
+	}
+	if len(log.segments) == 0 {
+		log.segments = append(log.segments, &segment{id: 1, modTime: time.Now()})
+	}
+
+	// a crash may have left half a record at the end of the active segment
+	last := log.segments[len(log.segments)-1]
+	valid, err := log.validLength(last)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(log.path(last.id), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open segment error")
+	}
+	if valid < last.size {
+		fmt.Printf("[WAL]: Truncating %d bytes of torn write in %s\n", last.size-valid, log.path(last.id))
+		if err := file.Truncate(valid); err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, "truncate segment error")
+		}
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "seek segment error")
+	}
+	last.size = valid
+	log.active = file
+	return log, nil
+}
+
+func (log *Log) load() error {
+	entries, err := os.ReadDir(log.options.Dir)
+	if err != nil {
+		return errors.Wrap(err, "read log dir error")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, compactExt) {
+			if err := os.Remove(filepath.Join(log.options.Dir, name)); err != nil {
+				return errors.Wrap(err, "remove unfinished compaction error")
+			}
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return errors.Wrap(err, "stat segment error")
+		}
+		log.segments = append(log.segments, &segment{id: id, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(log.segments, func(i, j int) bool { return log.segments[i].id < log.segments[j].id })
+	return nil
+}
+
+func (log *Log) path(id uint64) string {
+	return filepath.Join(log.options.Dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// validLength is the length of the segment up to the first incomplete or corrupted record.
+func (log *Log) validLength(seg *segment) (int64, error) {
+	file, err := os.Open(log.path(seg.id))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "open segment error")
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		data, err := readRecord(reader)
+		if err != nil {
+			return valid, nil
+		}
+		valid += int64(headerSize + len(data))
+	}
+}
+
+// Append writes a record to the active segment, starting a new segment if it's full.
+func (log *Log) Append(data []byte) error {
+	if len(data) > MaxRecordSize {
+		return errors.Wrapf(ErrRecordTooLarge, "%d bytes", len(data))
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if log.closed {
+		return ErrClosed
+	}
+
+	active := log.segments[len(log.segments)-1]
+	if active.size > 0 && active.size+int64(headerSize+len(data)) > log.options.SegmentSize {
+		if err := log.roll(); err != nil {
+			return err
+		}
+		active = log.segments[len(log.segments)-1]
+	}
+
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(data, crcTable))
+	copy(record[headerSize:], data)
+	if _, err := log.active.Write(record); err != nil {
+		// don't leave half a record for the next one to be appended after
+		if truncateErr := log.active.Truncate(active.size); truncateErr == nil {
+			log.active.Seek(active.size, io.SeekStart)
+		}
+		return errors.Wrap(err, "write record error")
+	}
+	active.size += int64(len(record))
+	active.modTime = time.Now()
+	if log.options.Sync {
+		if err := log.active.Sync(); err != nil {
+			return errors.Wrap(err, "sync segment error")
+		}
+	}
+	return nil
+}
+
+func (log *Log) roll() error {
+	if err := log.active.Close(); err != nil {
+		return errors.Wrap(err, "close segment error")
+	}
+	id := log.segments[len(log.segments)-1].id + 1
+	file, err := os.OpenFile(log.path(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create segment error")
+	}
+	log.active = file
+	log.segments = append(log.segments, &segment{id: id, modTime: time.Now()})
+	return log.applyRetention()
+}
+
+// Replay calls fn with every record from the oldest to the newest, stopping at the first error fn returns.
+// A corrupted sealed segment is renamed aside and skipped, the records before the corruption are still replayed.
+func (log *Log) Replay(fn func(data []byte) error) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	for i := 0; i < len(log.segments); {
+		seg := log.segments[i]
+		var fnErr error
+		err := log.replaySegment(seg, func(data []byte) error {
+			fnErr = fn(data)
+			return fnErr
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil && errors.Cause(err) == ErrCorrupt && i < len(log.segments)-1 {
+			if err := log.quarantine(seg, err); err != nil {
+				return err
+			}
+			log.segments = append(log.segments[:i:i], log.segments[i+1:]...)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+// quarantine moves a corrupted sealed segment out of the log.
+func (log *Log) quarantine(seg *segment, cause error) error {
+	fmt.Printf("[WAL]: Skipping the rest of %s: %s\n", log.path(seg.id), cause)
+	if err := os.Rename(log.path(seg.id), log.path(seg.id)+corruptExt); err != nil {
+		return errors.Wrap(err, "quarantine corrupted segment error")
+	}
+	return nil
+}
+
+func (log *Log) replaySegment(seg *segment, fn func(data []byte) error) error {
+	file, err := os.Open(log.path(seg.id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "open segment error")
+	}
+	defer file.Close()
+
+	// never read beyond what's been accounted for
+	reader := bufio.NewReader(io.LimitReader(file, seg.size))
+	for {
+		data, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "read segment %s error", log.path(seg.id))
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+}
+
+func readRecord(reader io.Reader) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.Wrap(ErrCorrupt, "truncated header")
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > MaxRecordSize {
+		return nil, errors.Wrapf(ErrCorrupt, "record length %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, errors.Wrap(ErrCorrupt, "truncated record")
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.Wrap(ErrCorrupt, "checksum mismatch")
+	}
+	return data, nil
+}
+
+// ApplyRetention removes the oldest segments beyond MaxSize or MaxAge, never the active one.
+func (log *Log) ApplyRetention() error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.applyRetention()
+}
+
+func (log *Log) applyRetention() error {
+	if log.compacting {
+		// the segments may be replaced any time, the next roll or ApplyRetention catches up
+		return nil
+	}
+	var total int64
+	for _, seg := range log.segments {
+		total += seg.size
+	}
+	for len(log.segments) > 1 {
+		oldest := log.segments[0]
+		tooBig := log.options.MaxSize > 0 && total > log.options.MaxSize
+		tooOld := log.options.MaxAge > 0 && time.Since(oldest.modTime) > log.options.MaxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		if err := os.Remove(log.path(oldest.id)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove segment error")
+		}
+		total -= oldest.size
+		log.segments = log.segments[1:]
+	}
+	return nil
+}
+
+// Compact rewrites all segments but the active one, keeping only the records keep returns true for.
+// The kept records are packed into as few segments as possible, reusing the ids of the oldest ones.
+// Appends go on while the segments are rewritten, the lock is only taken to swap them in.
+// A crash in the middle may leave some kept records twice, never lose them.
+func (log *Log) Compact(keep func(data []byte) bool) error {
+	log.compactMu.Lock()
+	defer log.compactMu.Unlock()
+
+	log.mu.Lock()
+	if log.closed {
+		log.mu.Unlock()
+		return ErrClosed
+	}
+	// sealed segments are never written to again, only retention removes them, and it waits
+	sealed := append([]*segment{}, log.segments[:len(log.segments)-1]...)
+	if len(sealed) == 0 {
+		log.mu.Unlock()
+		return nil
+	}
+	log.compacting = true
+	log.mu.Unlock()
+	defer func() {
+		log.mu.Lock()
+		log.compacting = false
+		log.mu.Unlock()
+	}()
+
+	var compacted []*segment
+	var file *os.File
+	finish := func() error {
+		if file == nil {
+			return nil
+		}
+		err := file.Sync()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		file = nil
+		return errors.Wrap(err, "finish compacted segment error")
+	}
+	abort := func(err error) error {
+		if file != nil {
+			file.Close()
+		}
+		for _, seg := range compacted {
+			os.Remove(log.path(seg.id) + compactExt)
+		}
+		return err
+	}
+
+	for _, seg := range sealed {
+		if log.isClosed() {
+			return abort(ErrClosed)
+		}
+		err := log.replaySegment(seg, func(data []byte) error {
+			if !keep(data) {
+				return nil
+			}
+			recordSize := int64(headerSize + len(data))
+			current := len(compacted) - 1
+			if file == nil || compacted[current].size+recordSize > log.options.SegmentSize {
+				if err := finish(); err != nil {
+					return err
+				}
+				// the output never needs more segments than the input, so there is always an id to reuse
+				next := &segment{id: sealed[len(compacted)].id, modTime: seg.modTime}
+				var err error
+				file, err = os.OpenFile(log.path(next.id)+compactExt, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+				if err != nil {
+					return errors.Wrap(err, "create compacted segment error")
+				}
+				compacted = append(compacted, next)
+				current++
+			}
+			record := make([]byte, recordSize)
+			binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+			binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(data, crcTable))
+			copy(record[headerSize:], data)
+			if _, err := file.Write(record); err != nil {
+				return errors.Wrap(err, "write compacted record error")
+			}
+			compacted[current].size += recordSize
+			compacted[current].modTime = seg.modTime
+			return nil
+		})
+		if err != nil {
+			return abort(err)
+		}
+	}
+	if err := finish(); err != nil {
+		return abort(err)
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.closed {
+		return abort(ErrClosed)
+	}
+	for i, seg := range compacted {
+		if err := os.Rename(log.path(seg.id)+compactExt, log.path(seg.id)); err != nil {
+			// the segments replaced already are kept in the list, the others are as they were
+			copy(log.segments, compacted[:i])
+			for _, seg := range compacted[i:] {
+				os.Remove(log.path(seg.id) + compactExt)
+			}
+			return errors.Wrap(err, "replace segment error")
+		}
+		// the time only matters to retention, the segment is replaced either way
+		if err := os.Chtimes(log.path(seg.id), seg.modTime, seg.modTime); err != nil {
+			fmt.Println(errors.Wrap(err, "keep segment time error"))
+		}
+	}
+	for _, seg := range sealed[len(compacted):] {
+		// a segment left behind only holds records kept twice, which replaying tolerates
+		if err := os.Remove(log.path(seg.id)); err != nil && !os.IsNotExist(err) {
+			fmt.Println(errors.Wrap(err, "remove segment error"))
+		}
+	}
+
+	// segments rolled in the meantime come after the sealed ones
+	log.segments = append(compacted, log.segments[len(sealed):]...)
+	return nil
+}
+
+func (log *Log) isClosed() bool {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.closed
+}
+
+// Close stops appending, it waits for a compaction in progress to give up.
+func (log *Log) Close() error {
+	log.mu.Lock()
+	if log.closed {
+		log.mu.Unlock()
+		return nil
+	}
+	log.closed = true
+	err := log.active.Close()
+	log.mu.Unlock()
+
+	log.compactMu.Lock()
+	log.compactMu.Unlock()
+	return err
+}
@@ -0,0 +1,118 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func openTestLog(t *testing.T, dir string) *Log {
+	t.Helper()
+	log, err := Open(Options{Dir: dir, SegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+func replayAll(t *testing.T, log *Log) []string {
+	t.Helper()
+	var records []string
+	if err := log.Replay(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestReplaySkipsCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	log := openTestLog(t, dir)
+	// 21 bytes with the header, 3 records per segment
+	for i := 0; i < 6; i++ {
+		if err := log.Append([]byte(fmt.Sprintf("record-%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Close()
+
+	// flip a byte in the last record of the first segment
+	path := filepath.Join(dir, fmt.Sprintf("%020d%s", 1, segmentExt))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	log = openTestLog(t, dir)
+	defer log.Close()
+	records := replayAll(t, log)
+	expected := "record-000000 record-000001 record-000003 record-000004 record-000005"
+	if got := strings.Join(records, " "); got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+	if _, err := os.Stat(path + corruptExt); err != nil {
+		t.Fatalf("expected the corrupted segment to be set aside: %v", err)
+	}
+	// the rest of the log is still usable
+	if err := log.Compact(func([]byte) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(replayAll(t, log), " "); got != "record-000003 record-000004 record-000005" {
+		t.Fatalf("unexpected records after compaction: %q", got)
+	}
+}
+
+func TestCompactWhileAppending(t *testing.T) {
+	log := openTestLog(t, t.TempDir())
+	defer log.Close()
+	for i := 0; i < 100; i++ {
+		if err := log.Append([]byte(fmt.Sprintf("old-%09d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := log.Append([]byte(fmt.Sprintf("new-%09d", i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	err := log.Compact(func(data []byte) bool {
+		// only the even old records are kept
+		var n int
+		fmt.Sscanf(string(data), "old-%d", &n)
+		return n%2 == 0
+	})
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, record := range replayAll(t, log) {
+		seen[record] = true
+	}
+	for i := 0; i < 100; i++ {
+		if !seen[fmt.Sprintf("new-%09d", i)] {
+			t.Fatalf("lost new-%09d", i)
+		}
+		// the last old record is in the segment that was active when compaction started
+		if old := fmt.Sprintf("old-%09d", i); i%2 == 0 && !seen[old] && i < 98 {
+			t.Fatalf("lost %s", old)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Package websocket is the server side of the WebSocket protocol (RFC 6455),
+// just what's needed to let browsers into the broadcast server: no extensions, no subprotocols.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseInvalidData     = 1007
+	CloseMessageTooLarge = 1009
+)
+
+var (
+	ErrMessageTooLarge = errors.New("websocket message too large")
+	ErrProtocol        = errors.New("websocket protocol error")
+)
+
+// closeTimeout is how long the close frame gets to be written when closing.
+const closeTimeout = time.Second
+
+// Conn is a WebSocket connection, deadlines and addresses are the ones of the underlying connection.
+type Conn struct {
+	net.Conn
+	reader         *bufio.Reader
+	maxMessageSize int
+
+	writeMu sync.Mutex
+	// closeSent is set once a close frame is written, nothing can be written after it
+	closeSent bool
+	closeOnce sync.Once
+}
+
+// Upgrade answers the opening handshake of a WebSocket request, and takes over its connection.
+// Browsers are only accepted from the same origin as the page serving them.
+// Messages larger than maxMessageSize bytes are refused.
+func Upgrade(w http.ResponseWriter, r *http.Request, maxMessageSize int) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.Wrap(ErrProtocol, "handshake method is not GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.Wrap(ErrProtocol, "not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, errors.Wrap(ErrProtocol, "unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.Wrap(ErrProtocol, "missing Sec-WebSocket-Key")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "cross-origin websocket refused", http.StatusForbidden)
+			return nil, errors.New("cross-origin websocket from " + origin + " refused")
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer can't be hijacked")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, "hijack connection error")
+	}
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "write handshake error")
+	}
+	return &Conn{Conn: conn, reader: buffered.Reader, maxMessageSize: maxMessageSize}, nil
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, putting fragments back together
+// and answering pings on the way. It returns io.EOF once the peer closed the connection.
+func (conn *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		fin, opcode, payload, err := conn.readFrame()
+		if err != nil {
+			return nil, conn.fail(err)
+		}
+		switch opcode {
+		case opPing:
+			if err := conn.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			conn.writeClose(code, "")
+			return nil, io.EOF
+		case opText, opBinary:
+			if fragmented {
+				return nil, conn.fail(errors.Wrap(ErrProtocol, "new message before the last one finished"))
+			}
+			message = payload
+			fragmented = !fin
+		case opContinuation:
+			if !fragmented {
+				return nil, conn.fail(errors.Wrap(ErrProtocol, "continuation without a message"))
+			}
+			if len(message)+len(payload) > conn.maxMessageSize {
+				return nil, conn.fail(ErrMessageTooLarge)
+			}
+			message = append(message, payload...)
+			fragmented = !fin
+		default:
+			return nil, conn.fail(errors.Wrapf(ErrProtocol, "unknown opcode %d", opcode))
+		}
+		if !fragmented {
+			// binary messages are taken as text too, the broadcast protocol is text
+			if !utf8.Valid(message) {
+				conn.writeClose(CloseInvalidData, "invalid utf-8")
+				return nil, errors.Wrap(ErrProtocol, "invalid utf-8 in message")
+			}
+			return message, nil
+		}
+	}
+}
+
+func (conn *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, errors.Wrap(ErrProtocol, "reserved bits set")
+	}
+	opcode = header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.Wrap(ErrProtocol, "unmasked frame from client")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(conn.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(conn.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= opClose && (!fin || length > 125) {
+		return false, 0, nil, errors.Wrap(ErrProtocol, "invalid control frame")
+	}
+	if length > uint64(conn.maxMessageSize) {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(conn.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(conn.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// fail closes the connection with the status code matching err, if err comes from the peer.
+func (conn *Conn) fail(err error) error {
+	switch errors.Cause(err) {
+	case ErrProtocol:
+		conn.writeClose(CloseProtocolError, "")
+	case ErrMessageTooLarge:
+		conn.writeClose(CloseMessageTooLarge, "")
+	case io.ErrUnexpectedEOF:
+		return io.EOF
+	}
+	return err
+}
+
+// WriteMessage sends a text message, safe to call concurrently.
+func (conn *Conn) WriteMessage(message []byte) error {
+	return conn.writeFrame(opText, message)
+}
+
+func (conn *Conn) writeFrame(opcode byte, payload []byte) error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	if conn.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == opClose {
+		conn.closeSent = true
+	}
+
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	_, err := conn.Conn.Write(frame)
+	return err
+}
+
+func (conn *Conn) writeClose(code int, reason string) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	conn.writeFrame(opClose, payload)
+}
+
+// Close sends a close frame, if none was sent yet, and closes the connection.
+func (conn *Conn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		conn.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		conn.writeClose(CloseGoingAway, "")
+		err = conn.Conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,400 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// frame is a frame from a client, masked unless told otherwise.
+type frame struct {
+	fin      bool
+	opcode   byte
+	payload  string
+	unmasked bool
+	reserved bool
+}
+
+func (f frame) encode() []byte {
+	first := f.opcode
+	if f.fin {
+		first |= 0x80
+	}
+	if f.reserved {
+		first |= 0x40
+	}
+	data := []byte{first}
+	var mask byte
+	if !f.unmasked {
+		mask = 0x80
+	}
+	switch length := len(f.payload); {
+	case length <= 125:
+		data = append(data, mask|byte(length))
+	case length <= 0xFFFF:
+		data = append(data, mask|126, byte(length>>8), byte(length))
+	default:
+		data = append(data, mask|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(data[2:], uint64(length))
+	}
+	if f.unmasked {
+		return append(data, f.payload...)
+	}
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+	data = append(data, key...)
+	for i := 0; i < len(f.payload); i++ {
+		data = append(data, f.payload[i]^key[i%4])
+	}
+	return data
+}
+
+// readReply reads a frame from the server, which are never masked, as "<opcode> <payload>",
+// with the status code as the payload of close frames.
+func readReply(reader *bufio.Reader) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return "", err
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		return "", errors.New("server frames are final and unmasked")
+	}
+	length := uint64(header[1])
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return "", err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return "", err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return "", err
+	}
+	switch header[0] & 0x0F {
+	case opText:
+		return "text " + string(payload), nil
+	case opPong:
+		return "pong " + string(payload), nil
+	case opClose:
+		return fmt.Sprintf("close %d", binary.BigEndian.Uint16(payload)), nil
+	}
+	return fmt.Sprintf("opcode %d", header[0]&0x0F), nil
+}
+
+// pipe returns a server connection, and the other end of it.
+func pipe(maxMessageSize int) (*Conn, net.Conn) {
+	server, client := net.Pipe()
+	return &Conn{Conn: server, reader: bufio.NewReader(server), maxMessageSize: maxMessageSize}, client
+}
+
+func TestReadMessage(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	longer := strings.Repeat("y", 70000)
+	for _, c := range []struct {
+		name           string
+		maxMessageSize int
+		frames         []frame
+		messages       []string
+		err            error
+		replies        []string
+	}{
+		{
+			name:     "text",
+			frames:   []frame{{fin: true, opcode: opText, payload: "hello"}, {fin: true, opcode: opBinary, payload: "world"}},
+			messages: []string{"hello", "world"},
+		},
+		{
+			name:     "16-bit length",
+			frames:   []frame{{fin: true, opcode: opText, payload: long}},
+			messages: []string{long},
+		},
+		{
+			name:           "64-bit length",
+			maxMessageSize: 100000,
+			frames:         []frame{{fin: true, opcode: opText, payload: longer}},
+			messages:       []string{longer},
+		},
+		{
+			name: "fragmented",
+			frames: []frame{
+				{opcode: opText, payload: "hel"},
+				{opcode: opContinuation, payload: "lo "},
+				{fin: true, opcode: opContinuation, payload: "world"},
+			},
+			messages: []string{"hello world"},
+		},
+		{
+			name: "control frames inside a fragmented message",
+			frames: []frame{
+				{opcode: opText, payload: "hello "},
+				{fin: true, opcode: opPing, payload: "are you there"},
+				{fin: true, opcode: opPong, payload: "unasked"},
+				{fin: true, opcode: opContinuation, payload: "world"},
+			},
+			messages: []string{"hello world"},
+			replies:  []string{"pong are you there"},
+		},
+		{
+			name:    "close handshake",
+			frames:  []frame{{fin: true, opcode: opClose, payload: "\x03\xe8"}},
+			err:     io.EOF,
+			replies: []string{"close 1000"},
+		},
+		{
+			name:    "close without a status code",
+			frames:  []frame{{fin: true, opcode: opClose}},
+			err:     io.EOF,
+			replies: []string{"close 1000"},
+		},
+		{
+			name:    "unmasked",
+			frames:  []frame{{fin: true, opcode: opText, payload: "hello", unmasked: true}},
+			err:     ErrProtocol,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "reserved bits",
+			frames:  []frame{{fin: true, opcode: opText, payload: "hello", reserved: true}},
+			err:     ErrProtocol,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "unknown opcode",
+			frames:  []frame{{fin: true, opcode: 0x3, payload: "hello"}},
+			err:     ErrProtocol,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "fragmented control frame",
+			frames:  []frame{{opcode: opPing, payload: "ping"}},
+			err:     ErrProtocol,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "control frame too long",
+			frames:  []frame{{fin: true, opcode: opPing, payload: strings.Repeat("p", 126)}},
+			err:     ErrProtocol,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "continuation without a message",
+			frames:  []frame{{fin: true, opcode: opContinuation, payload: "hello"}},
+			err:     ErrProtocol,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "new message before the last one finished",
+			frames:  []frame{{opcode: opText, payload: "hello"}, {fin: true, opcode: opText, payload: "world"}},
+			err:     ErrProtocol,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "invalid utf-8",
+			frames:  []frame{{fin: true, opcode: opText, payload: "\xff\xfe"}},
+			err:     ErrProtocol,
+			replies: []string{"close 1007"},
+		},
+		{
+			name:           "frame too large",
+			maxMessageSize: 10,
+			frames:         []frame{{fin: true, opcode: opText, payload: "hello world"}},
+			err:            ErrMessageTooLarge,
+			replies:        []string{"close 1009"},
+		},
+		{
+			name:           "fragmented message too large",
+			maxMessageSize: 10,
+			frames:         []frame{{opcode: opText, payload: "hello "}, {fin: true, opcode: opContinuation, payload: "world"}},
+			err:            ErrMessageTooLarge,
+			replies:        []string{"close 1009"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if c.maxMessageSize == 0 {
+				c.maxMessageSize = 1024
+			}
+			conn, client := pipe(c.maxMessageSize)
+			defer client.Close()
+			go func() {
+				for _, f := range c.frames {
+					if _, err := client.Write(f.encode()); err != nil {
+						return
+					}
+				}
+			}()
+			replies := make(chan string, 16)
+			go func() {
+				defer close(replies)
+				reader := bufio.NewReader(client)
+				for {
+					reply, err := readReply(reader)
+					if err != nil {
+						return
+					}
+					replies <- reply
+				}
+			}()
+
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			var messages []string
+			var err error
+			for err == nil && (len(messages) < len(c.messages) || c.err != nil) {
+				var message []byte
+				if message, err = conn.ReadMessage(); err == nil {
+					messages = append(messages, string(message))
+				}
+			}
+			if errors.Cause(err) != c.err {
+				t.Fatalf("expected error %v, got %v", c.err, err)
+			}
+			if strings.Join(messages, "|") != strings.Join(c.messages, "|") {
+				t.Fatalf("expected messages %q, got %q", c.messages, messages)
+			}
+
+			conn.Conn.Close()
+			var got []string
+			for reply := range replies {
+				got = append(got, reply)
+			}
+			if strings.Join(got, "|") != strings.Join(c.replies, "|") {
+				t.Fatalf("expected replies %q, got %q", c.replies, got)
+			}
+		})
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	conn, client := pipe(1024)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(client)
+	for _, size := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		message := strings.Repeat("m", size)
+		go conn.WriteMessage([]byte(message))
+		reply, err := readReply(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != "text "+message {
+			t.Fatalf("expected a text frame of %d bytes, got %d bytes", size, len(reply)-len("text "))
+		}
+	}
+
+	// nothing is written after the close frame
+	go conn.Close()
+	if reply, err := readReply(reader); err != nil || reply != "close 1001" {
+		t.Fatalf("expected a close frame, got %q, %v", reply, err)
+	}
+	if err := conn.WriteMessage([]byte("too late")); err == nil {
+		t.Fatal("expected writing after closing to fail")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	upgraded := make(chan *Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, 1024)
+		if err == nil {
+			upgraded <- conn
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	request := func(method string, header map[string]string) *http.Response {
+		t.Helper()
+		r, err := http.NewRequest(method, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response
+	}
+	valid := func(changes map[string]string) map[string]string {
+		header := map[string]string{
+			"Connection":            "keep-alive, Upgrade",
+			"Upgrade":               "websocket",
+			"Sec-WebSocket-Version": "13",
+			"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+		}
+		for name, value := range changes {
+			header[name] = value
+		}
+		return header
+	}
+	for _, c := range []struct {
+		name   string
+		method string
+		header map[string]string
+		status int
+	}{
+		{"not GET", http.MethodPost, valid(nil), http.StatusMethodNotAllowed},
+		{"not an upgrade", http.MethodGet, valid(map[string]string{"Upgrade": "h2c"}), http.StatusUpgradeRequired},
+		{"unsupported version", http.MethodGet, valid(map[string]string{"Sec-WebSocket-Version": "8"}), http.StatusBadRequest},
+		{"missing key", http.MethodGet, valid(map[string]string{"Sec-WebSocket-Key": ""}), http.StatusBadRequest},
+		{"cross-origin", http.MethodGet, valid(map[string]string{"Origin": "http://evil.example"}), http.StatusForbidden},
+	} {
+		if response := request(c.method, c.header); response.StatusCode != c.status {
+			t.Fatalf("%s: expected status %d, got %d", c.name, c.status, response.StatusCode)
+		}
+	}
+
+	// the key and the accept value are the ones of the example of RFC 6455
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	handshake := "GET /chat HTTP/1.1\r\nHost: " + host + "\r\nOrigin: http://" + host + "\r\n"
+	for name, value := range valid(nil) {
+		handshake += name + ": " + value + "\r\n"
+	}
+	if _, err := conn.Write([]byte(handshake + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the connection to be upgraded, got status %d", response.StatusCode)
+	}
+	if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", accept)
+	}
+
+	// a frame sent right after the handshake isn't lost in the buffer of the HTTP server
+	if _, err := conn.Write(frame{fin: true, opcode: opText, payload: "hello"}.encode()); err != nil {
+		t.Fatal(err)
+	}
+	ws := <-upgraded
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(2 * time.Second))
+	if message, err := ws.ReadMessage(); err != nil || string(message) != "hello" {
+		t.Fatalf("expected the message, got %q, %v", message, err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// sendFiles opens the files and passes their descriptors to the server in a single message,
+// the message itself has their names, a stream socket can't carry descriptors without data.
+func sendFiles(conn net.Conn, paths []string) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("file descriptors can only be passed over unix sockets")
+	}
+	if len(paths) == 0 {
+		return errors.New("no file to send")
+	}
+	var fds []int
+	var names []string
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "open file error")
+		}
+		// the descriptor is duplicated into the server when sent, ours can be closed right after
+		defer file.Close()
+		fds = append(fds, int(file.Fd()))
+		names = append(names, filepath.Base(path))
+	}
+	_, _, err := unixConn.WriteMsgUnix([]byte(strings.Join(names, " ")), syscall.UnixRights(fds...), nil)
+	if err != nil {
+		return errors.Wrap(err, "send file descriptors error")
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"net"
+)
+
+func sendFiles(conn net.Conn, paths []string) error {
+	return errors.New("file descriptor passing is only supported on linux")
+}
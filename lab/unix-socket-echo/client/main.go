@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/spongeprojects/magicconch"
@@ -29,15 +30,20 @@ func (client *Client) receive() {
 			break
 		}
 		if length > 0 {
-			fmt.Println("[RECEIVED]: " + string(message))
+			fmt.Println("[RECEIVED]: " + string(message[:length]))
 		}
 	}
 }
 
 func main() {
+	network := flag.String("network", "tcp", "network to connect to: tcp or unix")
+	address := flag.String("address", "localhost:12345", "address to connect to, a file path for unix")
+	fdPassing := flag.Bool("fd-passing", false, "send the files named on every line, separated by spaces, as open file descriptors, unix only")
+	flag.Parse()
+
 	fmt.Println("Starting client...")
 
-	conn, err := net.Dial("tcp", "localhost:12345")
+	conn, err := net.Dial(*network, *address)
 	magicconch.Must(err)
 
 	client := &Client{socket: conn}
@@ -45,12 +51,19 @@ func main() {
 	go client.receive()
 
 	fmt.Println("[WAITING]")
+	reader := bufio.NewReader(os.Stdin)
 	for {
-		reader := bufio.NewReader(os.Stdin)
-		message, _ := reader.ReadString('\n')
+		message, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
 		message = strings.Trim(message, "\n")
 		fmt.Println("[SENDING]: " + message)
-		_, err := conn.Write([]byte(message))
+		if *fdPassing {
+			err = sendFiles(conn, strings.Fields(message))
+		} else {
+			_, err = conn.Write([]byte(message))
+		}
 		if err != nil {
 			fmt.Println(errors.Wrap(err, "send message error"))
 		}
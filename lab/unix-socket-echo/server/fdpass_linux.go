@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// fileReader reads messages carrying open file descriptors (SCM_RIGHTS), and takes
+// the contents of the files instead of the messages as frames. Messages without descriptors are taken as is.
+type fileReader struct {
+	conn *net.UnixConn
+}
+
+func newFileReader(conn net.Conn) socketserver.FrameReader {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return &noticeReader{notice: []byte("[ERROR]: file descriptors can only be passed over unix sockets\n")}
+	}
+	return &fileReader{conn: unixConn}
+}
+
+func (reader *fileReader) ReadFrame() ([]byte, error) {
+	for {
+		message := make([]byte, bufferSize)
+		oob := make([]byte, syscall.CmsgSpace(maxFDs*4))
+		length, oobLength, flags, _, err := reader.conn.ReadMsgUnix(message, oob)
+		if err != nil {
+			return nil, err
+		}
+		if oobLength == 0 {
+			if length > 0 {
+				return message[:length], nil
+			}
+			continue
+		}
+
+		files, err := parseRights(oob[:oobLength])
+		if err == nil && flags&syscall.MSG_CTRUNC != 0 {
+			// the kernel closed the descriptors that didn't fit, the ones that did are no use alone
+			err = errors.Errorf("control message truncated, at most %d file descriptors per message", maxFDs)
+		}
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			fmt.Println(errors.Wrap(err, "receive file descriptors error"))
+			return []byte("[ERROR]: " + err.Error() + "\n"), nil
+		}
+		fmt.Printf("[RECEIVED]: %d file descriptors with %q\n", len(files), message[:length])
+		var frame []byte
+		for _, file := range files {
+			frame = append(frame, readPassedFile(file)...)
+		}
+		return frame, nil
+	}
+}
+
+// parseRights turns the descriptors in a control message into files, the caller closes them.
+func parseRights(oob []byte) ([]*os.File, error) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse control message error")
+	}
+	var files []*os.File
+	for _, message := range messages {
+		if message.Header.Level != syscall.SOL_SOCKET || message.Header.Type != syscall.SCM_RIGHTS {
+			continue
+		}
+		fds, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			return files, errors.Wrap(err, "parse unix rights error")
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd)))
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("control message without file descriptors")
+	}
+	return files, nil
+}
+
+// readPassedFile reads up to maxFileSize bytes of a passed file and closes it,
+// only regular files are read, anything else could block forever.
+func readPassedFile(file *os.File) []byte {
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return []byte("[ERROR]: " + errors.Wrap(err, "stat passed file error").Error() + "\n")
+	}
+	if !info.Mode().IsRegular() {
+		return []byte(fmt.Sprintf("[ERROR]: %s is not a regular file (%s)\n", file.Name(), info.Mode().Type()))
+	}
+	contents, err := io.ReadAll(io.LimitReader(file, maxFileSize))
+	if err != nil {
+		return []byte("[ERROR]: " + errors.Wrap(err, "read passed file error").Error() + "\n")
+	}
+	header := fmt.Sprintf("[FILE]: %d of %d bytes\n", len(contents), info.Size())
+	return append([]byte(header), contents...)
+}
@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// socketpair returns both ends of a connected unix socket.
+func socketpair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []*net.UnixConn
+	for _, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns = append(conns, conn.(*net.UnixConn))
+	}
+	return conns[0], conns[1]
+}
+
+func tempFile(t *testing.T, contents string) *os.File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "passed")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func sendFiles(t *testing.T, conn *net.UnixConn, files ...*os.File) {
+	t.Helper()
+	var fds []int
+	for _, file := range files {
+		fds = append(fds, int(file.Fd()))
+	}
+	if _, _, err := conn.WriteMsgUnix([]byte("file"), syscall.UnixRights(fds...), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilePassing(t *testing.T) {
+	server, client := socketpair(t)
+	reader := newFileReader(server)
+
+	sendFiles(t, client, tempFile(t, "hello from a file\n"))
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[FILE]: 18 of 18 bytes\nhello from a file\n"
+	if string(frame) != expected {
+		t.Fatalf("expected %q, got %q", expected, frame)
+	}
+
+	// messages without descriptors are taken as is
+	if _, err := client.Write([]byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := reader.ReadFrame(); err != nil || string(frame) != "plain" {
+		t.Fatalf("expected the plain message, got %q, %v", frame, err)
+	}
+}
+
+func TestFilePassingTruncated(t *testing.T) {
+	server, client := socketpair(t)
+	reader := newFileReader(server)
+
+	// one more than the control message buffer holds
+	var files []*os.File
+	for i := 0; i <= maxFDs; i++ {
+		files = append(files, tempFile(t, "contents"))
+	}
+	sendFiles(t, client, files...)
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(frame), "[ERROR]: control message truncated") {
+		t.Fatalf("expected a truncation error, got %q", frame)
+	}
+	if bytes.Contains(frame, []byte("contents")) {
+		t.Fatalf("expected none of the files to be read, got %q", frame)
+	}
+
+	// the connection is still usable afterwards
+	sendFiles(t, client, tempFile(t, "next"))
+	if frame, err := reader.ReadFrame(); err != nil || !strings.HasSuffix(string(frame), "next") {
+		t.Fatalf("expected the next file, got %q, %v", frame, err)
+	}
+}
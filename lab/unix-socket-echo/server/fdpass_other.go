@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/wbsnail/articles/lab/socketserver"
+	"net"
+)
+
+// newFileReader only tells the client file descriptor passing is not supported.
+func newFileReader(net.Conn) socketserver.FrameReader {
+	return &noticeReader{notice: []byte("[ERROR]: file descriptor passing is only supported on linux\n")}
+}
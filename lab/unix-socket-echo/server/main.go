@@ -1,93 +1,77 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/spongeprojects/magicconch"
-	"net"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-type ClientManager struct {
-	clients      map[*Client]bool
-	registerCh   chan *Client
-	unregisterCh chan *Client
-}
-
-type Client struct {
-	socket net.Conn
-	data   chan []byte
-}
+func main() {
+	network := flag.String("network", "tcp", "network to listen on: tcp or unix")
+	address := flag.String("address", ":12345", "address to listen on, a file path for unix")
+	fdPassing := flag.Bool("fd-passing", false, "echo the contents of the files passed by clients instead of their messages, unix only")
+	lines := flag.Bool("lines", false, "echo line by line instead of what every read returns")
+	maxLineSize := flag.Int("max-line-size", 64*1024, "longest line in bytes with -lines, longer ones close the connection")
+	transformFlag := flag.String("transform", "none", "transform echoes: none, upper, reverse or hex for a hex dump, plain hex with -lines")
+	delay := flag.Duration("delay", 0, "wait before every write")
+	jitter := flag.Duration("jitter", 0, "wait up to this much more at random before every write")
+	resetRate := flag.Float64("reset-rate", 0, "chance from 0 to 1 that a write resets the connection instead")
+	chunkSize := flag.Int("chunk-size", 0, "split writes into random pieces of at most this many bytes, 0 writes them whole")
+	chunkDelay := flag.Duration("chunk-delay", 10*time.Millisecond, "wait between the pieces of a write split by -chunk-size")
+	scriptPath := flag.String("script", "", "reply with the responses in this file instead of echoing, see Script for the format")
+	flag.Parse()
 
-func (manager *ClientManager) start() {
-	for {
-		select {
-		case client := <-manager.registerCh:
-			manager.clients[client] = true
-			fmt.Println("[REGISTERED]: Client registered!")
-		case client := <-manager.unregisterCh:
-			if _, ok := manager.clients[client]; ok {
-				close(client.data)
-				delete(manager.clients, client)
-				fmt.Println("[UNREGISTERED]: Client unregistered!")
-			}
-		}
+	if *fdPassing && *network != "unix" {
+		magicconch.Must(errors.New("-fd-passing requires -network unix"))
 	}
-}
-
-func (manager *ClientManager) receive(client *Client) {
-	for {
-		message := make([]byte, 4096)
-		_, err := client.socket.Read(message)
-		if err != nil {
-			manager.unregisterCh <- client
-			client.socket.Close()
-			break
-		}
-		select {
-		case client.data <- message:
-		default:
-			close(client.data)
-			delete(manager.clients, client)
-		}
+	if *fdPassing && *lines {
+		magicconch.Must(errors.New("-fd-passing and -lines can't be used together"))
 	}
-}
-
-func (manager *ClientManager) send(client *Client) {
-	defer client.socket.Close()
-	for {
-		select {
-		case message, ok := <-client.data:
-			if !ok {
-				return
-			}
-			client.socket.Write(message)
-		}
+	if *resetRate < 0 || *resetRate > 1 {
+		magicconch.Must(errors.New("-reset-rate must be from 0 to 1"))
+	}
+	transform, err := ParseTransform(*transformFlag, *lines)
+	magicconch.Must(err)
+	mode := &Mode{
+		Lines:       *lines,
+		MaxLineSize: *maxLineSize,
+		FDPassing:   *fdPassing,
+		Transform:   transform,
+		Faults: Faults{
+			Delay:      *delay,
+			Jitter:     *jitter,
+			ResetRate:  *resetRate,
+			ChunkSize:  *chunkSize,
+			ChunkDelay: *chunkDelay,
+		},
+	}
+	if *scriptPath != "" {
+		mode.Script, err = LoadScript(*scriptPath)
+		magicconch.Must(err)
 	}
-}
 
-func main() {
 	fmt.Println("Starting server...")
 
-	listener, err := net.Listen("tcp", ":12345")
+	listeners, err := socketserver.InheritListeners()
 	magicconch.Must(err)
+	listener, err := listeners.Listen("echo", *network, *address)
+	magicconch.Must(err)
+	listeners.Close()
 
-	manager := ClientManager{
-		clients:      make(map[*Client]bool),
-		registerCh:   make(chan *Client),
-		unregisterCh: make(chan *Client),
-	}
-
-	go manager.start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// SIGHUP starts a new server on the same listener and shuts this one down, without refusing anybody
+	listeners.RestartOnHangup(stop)
 
-	fmt.Println("[WAITING]")
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println(errors.Wrap(err, "accept connection error"))
-		}
-		client := &Client{socket: conn, data: make(chan []byte)}
-		manager.registerCh <- client
-		go manager.receive(client)
-		go manager.send(client)
+	server := socketserver.NewServer(mode.handler(), mode.framing())
+	if err := server.Serve(ctx, listener); err != nil {
+		fmt.Println(err)
 	}
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"math/rand"
+	"net"
+	"time"
+	"unicode/utf8"
+)
+
+// transforms change what's echoed, a line ending at the end of a message is left where it is.
+var transforms = map[string]func([]byte) []byte{
+	"upper":   keepLineEnding(bytes.ToUpper),
+	"reverse": keepLineEnding(reverse),
+	"hex": keepLineEnding(func(message []byte) []byte {
+		return bytes.TrimSuffix([]byte(hex.Dump(message)), []byte("\n"))
+	}),
+}
+
+// lineTransforms replace transforms echoing line by line, whose echoes must fit on a line.
+var lineTransforms = map[string]func([]byte) []byte{
+	"hex": func(message []byte) []byte {
+		return []byte(hex.EncodeToString(message))
+	},
+}
+
+// ParseTransform returns nil for "none", lines picks the transforms for echoing line by line.
+func ParseTransform(name string, lines bool) (func([]byte) []byte, error) {
+	if name == "none" {
+		return nil, nil
+	}
+	if transform, ok := lineTransforms[name]; ok && lines {
+		return transform, nil
+	}
+	transform, ok := transforms[name]
+	if !ok {
+		return nil, errors.Errorf("unknown transform %q, must be none, upper, reverse or hex", name)
+	}
+	return transform, nil
+}
+
+func keepLineEnding(transform func([]byte) []byte) func([]byte) []byte {
+	return func(message []byte) []byte {
+		content := bytes.TrimRight(message, "\r\n")
+		ending := message[len(content):]
+		return append(transform(content), ending...)
+	}
+}
+
+// reverse reverses the characters of a message, invalid UTF-8 is reversed byte by byte.
+func reverse(message []byte) []byte {
+	reversed := make([]byte, 0, len(message))
+	for end := len(message); end > 0; {
+		_, size := utf8.DecodeLastRune(message[:end])
+		reversed = append(reversed, message[end-size:end]...)
+		end -= size
+	}
+	return reversed
+}
+
+// Faults make the server a bad peer, to test clients against. The zero value behaves.
+type Faults struct {
+	// Delay is waited before every write, plus a random duration up to Jitter
+	Delay  time.Duration
+	Jitter time.Duration
+	// ResetRate is the chance, from 0 to 1, that a write resets the connection instead
+	ResetRate float64
+	// ChunkSize splits writes into random pieces of at most ChunkSize bytes, ChunkDelay apart
+	ChunkSize  int
+	ChunkDelay time.Duration
+}
+
+func (faults Faults) wrap(conn net.Conn) net.Conn {
+	if faults == (Faults{}) {
+		return conn
+	}
+	return &faultyConn{Conn: conn, faults: faults}
+}
+
+type faultyConn struct {
+	net.Conn
+	faults Faults
+}
+
+func (conn *faultyConn) Write(p []byte) (int, error) {
+	delay := conn.faults.Delay
+	if conn.faults.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(conn.faults.Jitter)))
+	}
+	time.Sleep(delay)
+
+	if conn.faults.ResetRate > 0 && rand.Float64() < conn.faults.ResetRate {
+		fmt.Println("[RESET]: Resetting connection on purpose")
+		reset(conn.Conn)
+		return 0, net.ErrClosed
+	}
+
+	if conn.faults.ChunkSize <= 0 {
+		return conn.Conn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		size := 1 + rand.Intn(conn.faults.ChunkSize)
+		if size > len(p)-written {
+			size = len(p) - written
+		}
+		n, err := conn.Conn.Write(p[written : written+size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if written < len(p) {
+			time.Sleep(conn.faults.ChunkDelay)
+		}
+	}
+	return written, nil
+}
+
+// reset closes a TCP connection with a RST instead of a FIN, other connections are just closed.
+func reset(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
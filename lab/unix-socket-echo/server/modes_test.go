@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startEcho serves mode on a new listener and connects to it.
+func startEcho(t *testing.T, mode *Mode) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	server := socketserver.NewServer(mode.handler(), mode.framing())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Serve(ctx, listener) }()
+	t.Cleanup(func() {
+		stop()
+		<-stopped
+	})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+func TestTransforms(t *testing.T) {
+	long := "0123456789abcdefghij"
+	for _, c := range []struct {
+		name     string
+		lines    bool
+		message  string
+		expected string
+	}{
+		{"upper", false, "hello\r\n", "HELLO\r\n"},
+		{"upper", true, "hello", "HELLO"},
+		{"reverse", false, "héllo\n", "olléh\n"},
+		{"reverse", false, "ab\xffc", "c\xffba"},
+		{"hex", false, long + "\n", strings.TrimSuffix(hex.Dump([]byte(long)), "\n") + "\n"},
+		{"hex", true, long, hex.EncodeToString([]byte(long))},
+	} {
+		transform, err := ParseTransform(c.name, c.lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(transform([]byte(c.message))); got != c.expected {
+			t.Fatalf("%s of %q with lines %v: expected %q, got %q", c.name, c.message, c.lines, c.expected, got)
+		}
+	}
+
+	if transform, err := ParseTransform("none", false); err != nil || transform != nil {
+		t.Fatalf("expected no transform for none, got %v", err)
+	}
+	if _, err := ParseTransform("rot13", false); err == nil {
+		t.Fatal("expected an unknown transform to be refused")
+	}
+}
+
+// a hex dump over 16 bytes takes several lines, echoing line by line takes plain hex instead.
+func TestLinesHexEcho(t *testing.T) {
+	transform, err := ParseTransform("hex", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, reader := startEcho(t, &Mode{Lines: true, MaxLineSize: 1024, Transform: transform})
+	for _, line := range []string{"0123456789abcdefghij", "and the session goes on"} {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		expected := hex.EncodeToString([]byte(line)) + "\n"
+		if got, err := reader.ReadString('\n'); err != nil || got != expected {
+			t.Fatalf("expected %q, got %q, %v", expected, got, err)
+		}
+	}
+}
+
+func TestFaultsDisabled(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	if (Faults{}).wrap(conn) != conn {
+		t.Fatal("expected the zero faults to leave the connection as it is")
+	}
+}
+
+func TestFaultsDelay(t *testing.T) {
+	conn, reader := startEcho(t, &Mode{Faults: Faults{Delay: 50 * time.Millisecond, Jitter: 10 * time.Millisecond}})
+	started := time.Now()
+	conn.Write([]byte("hello"))
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(reader, data); err != nil || string(data) != "hello" {
+		t.Fatalf("expected the echo, got %q, %v", data, err)
+	}
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected the echo to be delayed, it took %s", elapsed)
+	}
+}
+
+func TestFaultsChunks(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	faulty := Faults{ChunkSize: 3}.wrap(conn)
+	message := "split into pieces"
+	go func() {
+		faulty.Write([]byte(message))
+		faulty.Close()
+	}()
+
+	// every write of a pipe is read on its own, so the pieces show
+	var received []byte
+	buffer := make([]byte, 64)
+	for {
+		n, err := peer.Read(buffer)
+		if n > 3 {
+			t.Fatalf("expected pieces of at most 3 bytes, got %q", buffer[:n])
+		}
+		received = append(received, buffer[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	if string(received) != message {
+		t.Fatalf("expected %q in pieces, got %q", message, received)
+	}
+}
+
+func TestFaultsReset(t *testing.T) {
+	conn, reader := startEcho(t, &Mode{Faults: Faults{ResetRate: 1}})
+	conn.Write([]byte("hello"))
+	_, err := reader.ReadByte()
+	if err == nil {
+		t.Fatal("expected the connection to be reset instead of the echo")
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("expected the connection to be reset, it's still open")
+	}
+}
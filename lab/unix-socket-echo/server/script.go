@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Script is a list of responses replayed instead of the echoes, one per message received,
+// the connection is closed once it's over. A script file has one step per line:
+//
+//	# a comment, skipped like blank lines
+//	!sleep 500ms    waits before going on
+//	!close          closes the connection
+//	!reset          resets it
+//	"\x00\xff"      a Go quoted string, written as is, bypassing the framing
+//	anything else   written as a frame
+//
+// A response is every step up to the next frame or quoted string, the steps after the last one
+// are played right after it.
+type Script struct {
+	steps []scriptStep
+}
+
+const (
+	stepSleep = "sleep"
+	stepClose = "close"
+	stepReset = "reset"
+	stepRaw   = "raw"
+	stepFrame = "frame"
+)
+
+type scriptStep struct {
+	kind  string
+	sleep time.Duration
+	data  []byte
+}
+
+func LoadScript(path string) (*Script, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	script := &Script{}
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		step, err := parseStep(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, number)
+		}
+		if step != nil {
+			script.steps = append(script.steps, *step)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+func parseStep(line string) (*scriptStep, error) {
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		return nil, nil
+	case strings.HasPrefix(trimmed, "!"):
+		fields := strings.Fields(trimmed)
+		switch {
+		case fields[0] == "!sleep" && len(fields) == 2:
+			duration, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			return &scriptStep{kind: stepSleep, sleep: duration}, nil
+		case fields[0] == "!close" && len(fields) == 1:
+			return &scriptStep{kind: stepClose}, nil
+		case fields[0] == "!reset" && len(fields) == 1:
+			return &scriptStep{kind: stepReset}, nil
+		}
+		return nil, errors.Errorf("unknown directive %q", trimmed)
+	case strings.HasPrefix(trimmed, `"`):
+		raw, err := strconv.Unquote(trimmed)
+		if err != nil {
+			return nil, errors.Wrap(err, "unquote error")
+		}
+		return &scriptStep{kind: stepRaw, data: []byte(raw)}, nil
+	}
+	return &scriptStep{kind: stepFrame, data: []byte(line)}, nil
+}
+
+// NewWriter returns a writer playing the script on conn, writing frames with writer.
+func (script *Script) NewWriter(conn net.Conn, writer socketserver.FrameWriter) socketserver.FrameWriter {
+	return &scriptWriter{script: script, conn: conn, writer: writer}
+}
+
+// scriptWriter plays the next response of the script for every frame it's given, whatever it is.
+// It runs in the send goroutine of the session, so it can take its time.
+type scriptWriter struct {
+	script *Script
+	conn   net.Conn
+	writer socketserver.FrameWriter
+	next   int
+}
+
+func (writer *scriptWriter) WriteFrame([]byte) error {
+	if err := writer.play(); err != nil {
+		return err
+	}
+	if writer.responsesLeft() {
+		return nil
+	}
+	// play the steps after the last response, and close
+	if err := writer.play(); err != nil {
+		return err
+	}
+	fmt.Println("[SCRIPT]: Script over, closing connection")
+	writer.conn.Close()
+	return net.ErrClosed
+}
+
+// WriteControl writes what the server says itself, like its goodbye, as it is.
+func (writer *scriptWriter) WriteControl(frame []byte) error {
+	return writer.writer.WriteFrame(frame)
+}
+
+// play plays the steps up to the end of the next response, or of the script.
+func (writer *scriptWriter) play() error {
+	for writer.next < len(writer.script.steps) {
+		step := writer.script.steps[writer.next]
+		writer.next++
+		switch step.kind {
+		case stepSleep:
+			time.Sleep(step.sleep)
+		case stepClose:
+			fmt.Println("[SCRIPT]: Closing connection")
+			writer.conn.Close()
+			return net.ErrClosed
+		case stepReset:
+			fmt.Println("[SCRIPT]: Resetting connection")
+			reset(writer.conn)
+			return net.ErrClosed
+		case stepRaw:
+			_, err := writer.conn.Write(step.data)
+			return err
+		case stepFrame:
+			return writer.writer.WriteFrame(step.data)
+		}
+	}
+	return nil
+}
+
+func (writer *scriptWriter) responsesLeft() bool {
+	for _, step := range writer.script.steps[writer.next:] {
+		if step.kind == stepRaw || step.kind == stepFrame {
+			return true
+		}
+	}
+	return false
+}
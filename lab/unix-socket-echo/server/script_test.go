@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScriptGoodbye(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script")
+	if err := os.WriteFile(path, []byte("first\nsecond\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script, err := LoadScript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode := &Mode{Lines: true, MaxLineSize: 1024, Script: script}
+	server := socketserver.NewServer(mode.handler(), mode.framing())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Serve(ctx, listener) }()
+	defer func() {
+		stop()
+		<-stopped
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("hello\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "first\n" {
+		t.Fatalf("expected the first response, got %q, %v", line, err)
+	}
+
+	// the goodbye is not replaced by the next response
+	stop()
+	if line, err := reader.ReadString('\n'); err != nil || line != "[SHUTDOWN]: server is shutting down\n" {
+		t.Fatalf("expected the goodbye, got %q, %v", line, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"github.com/wbsnail/articles/lab/socketserver"
+	"io"
+	"net"
+)
+
+const (
+	// bufferSize is the most a single read takes, and so the largest message echoed at once
+	bufferSize = 4096
+	// maxFDs is how many file descriptors a message can carry in the fd passing mode
+	maxFDs = 4
+	// maxFileSize is how much of a passed file is echoed
+	maxFileSize = 64 * 1024
+)
+
+// echoHandler echoes messages, and says goodbye to the clients when shutting down.
+type echoHandler struct {
+	socketserver.Handler
+	goodbye []byte
+}
+
+func (handler echoHandler) Shutdown(session *socketserver.Session) {
+	// it's not an echo, a script doesn't replace it
+	session.SendControl(handler.goodbye)
+}
+
+// Mode is how the server echoes, the zero value echoes what every read returns as it is.
+type Mode struct {
+	// Lines echoes line by line, lines over MaxLineSize bytes close the connection
+	Lines       bool
+	MaxLineSize int
+	// FDPassing echoes the contents of the files passed instead of the messages
+	FDPassing bool
+	Transform func([]byte) []byte
+	Faults    Faults
+	// Script replaces the echoes with scripted responses if it's not nil
+	Script *Script
+}
+
+func (mode *Mode) handler() socketserver.Handler {
+	handler := echoHandler{Handler: socketserver.Echo(), goodbye: []byte("[SHUTDOWN]: server is shutting down\n")}
+	if mode.Transform != nil {
+		handler.Handler = socketserver.RequestResponse(mode.Transform)
+	}
+	if mode.Lines {
+		// the framing ends lines itself
+		handler.goodbye = bytes.TrimSuffix(handler.goodbye, []byte("\n"))
+	}
+	return handler
+}
+
+func (mode *Mode) framing() socketserver.Framing {
+	base := socketserver.Raw(bufferSize)
+	if mode.Lines {
+		base = socketserver.Lines(mode.MaxLineSize)
+	}
+	reader := base.NewReader
+	if mode.FDPassing {
+		reader = newFileReader
+	}
+	return socketserver.FramingFunc{
+		Reader: reader,
+		Writer: func(conn net.Conn) socketserver.FrameWriter {
+			conn = mode.Faults.wrap(conn)
+			writer := base.NewWriter(conn)
+			if mode.Script != nil {
+				writer = mode.Script.NewWriter(conn, writer)
+			}
+			return writer
+		},
+	}
+}
+
+// noticeReader reads a single notice for the client, and the end of the connection after it.
+type noticeReader struct {
+	notice []byte
+}
+
+func (reader *noticeReader) ReadFrame() ([]byte, error) {
+	notice := reader.notice
+	if notice == nil {
+		return nil, io.EOF
+	}
+	reader.notice = nil
+	return notice, nil
+}